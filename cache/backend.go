@@ -0,0 +1,242 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
+)
+
+// Backend is the storage that cached paths are kept in
+type Backend string
+
+const (
+	// BackendS3 stores the caches in an S3 bucket
+	BackendS3 Backend = "s3"
+	// BackendMinIO stores the caches in a bucket of an S3 compatible
+	// endpoint, like MinIO
+	BackendMinIO Backend = "minio"
+	// BackendGCS stores the caches in a Google Cloud Storage bucket
+	BackendGCS Backend = "gcs"
+	// BackendAzure stores the caches in an Azure Blob Storage container
+	BackendAzure Backend = "azure"
+	// BackendVolume stores the caches in a directory of the host
+	// mounted into the steps
+	BackendVolume Backend = "volume"
+)
+
+// the images of the steps restoring and rebuilding the caches
+const (
+	s3CacheImage = "andrewstucki/s3-cache"
+	pluginImage  = "meltwater/drone-cache:1"
+)
+
+// defaultVolume is the host directory of the volume backend
+const defaultVolume = "/var/cache/drone"
+
+// volumeName is the name of the host volume of the volume backend, in
+// the namespace of the plugin so that it does not collide with the
+// volumes of the pipeline
+const volumeName = "infrastructure-cache"
+
+// ParseBackend parses a backend name
+func ParseBackend(s string) (Backend, error) {
+	switch backend := Backend(strings.ToLower(strings.TrimSpace(s))); backend {
+	case "":
+		return BackendS3, nil
+	case BackendS3, BackendMinIO, BackendGCS, BackendAzure, BackendVolume:
+		return backend, nil
+	case "s3-compatible":
+		return BackendMinIO, nil
+	}
+	return BackendS3, fmt.Errorf("unknown cache backend %q", s)
+}
+
+// storage generates the steps restoring and rebuilding caches kept in
+// a backend
+type storage interface {
+	// step returns the image and settings of the step restoring the
+	// cache, or rebuilding it
+	step(c cache, rebuild bool, used document.Secrets) *step
+	// volume returns the host volume the steps mount, if any
+	volume() *volume
+}
+
+// storage returns the storage of the cache, in the backend it names or
+// in the default backend
+func (p *plugin) storage(c cache) (storage, error) {
+	backend := p.backend
+	if c.Backend != "" {
+		var err error
+		if backend, err = ParseBackend(c.Backend); err != nil {
+			return nil, err
+		}
+	}
+	switch backend {
+	case BackendMinIO:
+		endpoint := c.Endpoint
+		if endpoint == "" {
+			endpoint = p.endpoint
+		}
+		if endpoint == "" {
+			return nil, errors.New("the minio cache backend is missing an endpoint")
+		}
+		return &minioStorage{endpoint: endpoint}, nil
+	case BackendGCS:
+		return &gcsStorage{}, nil
+	case BackendAzure:
+		return &azureStorage{}, nil
+	case BackendVolume:
+		return &volumeStorage{path: p.volume}, nil
+	}
+	return &s3Storage{}, nil
+}
+
+// s3Settings are the settings of the s3-cache plugin
+type s3Settings struct {
+	Pull      bool                `yaml:"pull"`
+	Restore   bool                `yaml:"restore,omitempty"`
+	Rebuild   bool                `yaml:"rebuild,omitempty"`
+	Hash      string              `yaml:"hash"`
+	Mount     []string            `yaml:"mount,omitempty"`
+	Root      document.FromSecret `yaml:"root"`
+	AccessKey document.FromSecret `yaml:"access_key"`
+	SecretKey document.FromSecret `yaml:"secret_key"`
+}
+
+type s3Storage struct{}
+
+func (s *s3Storage) step(c cache, rebuild bool, used document.Secrets) *step {
+	settings := &s3Settings{
+		Pull:      true,
+		Restore:   !rebuild,
+		Rebuild:   rebuild,
+		Hash:      c.Hash,
+		Root:      used.Ref("cache_bucket"),
+		AccessKey: used.Ref("cache_access_key"),
+		SecretKey: used.Ref("cache_secret_key"),
+	}
+	if rebuild {
+		settings.Mount = []string{c.Path}
+	}
+	return &step{Image: s3CacheImage, Settings: settings}
+}
+
+func (s *s3Storage) volume() *volume {
+	return nil
+}
+
+// pluginSettings are the settings of the drone-cache plugin, which
+// supports the other backends
+type pluginSettings struct {
+	Restore  bool     `yaml:"restore,omitempty"`
+	Rebuild  bool     `yaml:"rebuild,omitempty"`
+	Backend  string   `yaml:"backend"`
+	CacheKey string   `yaml:"cache_key"`
+	Mount    []string `yaml:"mount"`
+
+	// s3 compatible endpoints
+	Endpoint  string               `yaml:"endpoint,omitempty"`
+	PathStyle bool                 `yaml:"path_style,omitempty"`
+	Bucket    *document.FromSecret `yaml:"bucket,omitempty"`
+	AccessKey *document.FromSecret `yaml:"access_key,omitempty"`
+	SecretKey *document.FromSecret `yaml:"secret_key,omitempty"`
+	// google cloud storage
+	JSONKey *document.FromSecret `yaml:"json_key,omitempty"`
+	// azure blob storage
+	AccountName *document.FromSecret `yaml:"account_name,omitempty"`
+	AccountKey  *document.FromSecret `yaml:"account_key,omitempty"`
+	Container   *document.FromSecret `yaml:"container,omitempty"`
+	// host volume
+	CacheRoot string `yaml:"filesystem_cache_root,omitempty"`
+}
+
+// newPluginSettings returns the settings shared by the backends of the
+// drone-cache plugin, the key of a cache is made of the repository,
+// the path and either the checksum of the hash file or the branch
+func newPluginSettings(backend string, c cache, rebuild bool) *pluginSettings {
+	key := fmt.Sprintf("{{ .Repo.Name }}/%s/{{ .Commit.Branch }}", c.Path)
+	if c.Hash != "" {
+		key = fmt.Sprintf("{{ .Repo.Name }}/%s/{{ checksum %q }}", c.Path, c.Hash)
+	}
+	return &pluginSettings{
+		Restore:  !rebuild,
+		Rebuild:  rebuild,
+		Backend:  backend,
+		CacheKey: key,
+		Mount:    []string{c.Path},
+	}
+}
+
+func ref(used document.Secrets, name string) *document.FromSecret {
+	secret := used.Ref(name)
+	return &secret
+}
+
+type minioStorage struct {
+	endpoint string
+}
+
+func (s *minioStorage) step(c cache, rebuild bool, used document.Secrets) *step {
+	settings := newPluginSettings("s3", c, rebuild)
+	settings.Endpoint = s.endpoint
+	settings.PathStyle = true
+	settings.Bucket = ref(used, "cache_bucket")
+	settings.AccessKey = ref(used, "cache_access_key")
+	settings.SecretKey = ref(used, "cache_secret_key")
+	return &step{Image: pluginImage, Settings: settings}
+}
+
+func (s *minioStorage) volume() *volume {
+	return nil
+}
+
+type gcsStorage struct{}
+
+func (s *gcsStorage) step(c cache, rebuild bool, used document.Secrets) *step {
+	settings := newPluginSettings("gcs", c, rebuild)
+	settings.Bucket = ref(used, "cache_bucket")
+	settings.JSONKey = ref(used, "cache_gcs_json_key")
+	return &step{Image: pluginImage, Settings: settings}
+}
+
+func (s *gcsStorage) volume() *volume {
+	return nil
+}
+
+type azureStorage struct{}
+
+func (s *azureStorage) step(c cache, rebuild bool, used document.Secrets) *step {
+	settings := newPluginSettings("azure", c, rebuild)
+	settings.AccountName = ref(used, "cache_azure_account_name")
+	settings.AccountKey = ref(used, "cache_azure_account_key")
+	settings.Container = ref(used, "cache_bucket")
+	return &step{Image: pluginImage, Settings: settings}
+}
+
+func (s *azureStorage) volume() *volume {
+	return nil
+}
+
+// volumeStorage keeps the caches in a directory of the host, which is
+// mounted at the same path in the steps
+type volumeStorage struct {
+	path string
+}
+
+func (s *volumeStorage) step(c cache, rebuild bool, used document.Secrets) *step {
+	settings := newPluginSettings("filesystem", c, rebuild)
+	settings.CacheRoot = s.path
+	return &step{
+		Image:    pluginImage,
+		Volumes:  []mount{{Name: volumeName, Path: s.path}},
+		Settings: settings,
+	}
+}
+
+func (s *volumeStorage) volume() *volume {
+	v := &volume{Name: volumeName}
+	v.Host.Path = s.path
+	return v
+}
@@ -1,38 +1,87 @@
 package cache
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"io"
 
+	"github.com/andrewstucki/drone-infrastructure-plugin/chain"
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/converter"
 	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
+const name = "cache"
+
 type cache struct {
 	Hash string `yaml:"hash"` // the path to use for constructing a hash key
 	Path string `yaml:"path"` // the path of the location to cache
 	TTL  int    `yaml:"ttl"`  // the time the cache will be kept around
+	// Backend overrides the default backend, and Endpoint the endpoint
+	// of the minio backend
+	Backend  string `yaml:"backend"`
+	Endpoint string `yaml:"endpoint"`
+}
+
+type mount struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+}
+
+type step struct {
+	Name     string      `yaml:"name"`
+	Image    string      `yaml:"image"`
+	Volumes  []mount     `yaml:"volumes,omitempty"`
+	Settings interface{} `yaml:"settings"`
+}
+
+type volume struct {
+	Name string `yaml:"name"`
+	Host struct {
+		Path string `yaml:"path"`
+	} `yaml:"host"`
+}
+
+// secrets are the secret documents that the cache steps can reference
+var secrets = []*document.Secret{
+	document.NewSecret("cache_access_key", "drone", "cache-access-key"),
+	document.NewSecret("cache_secret_key", "drone", "cache-secret-key"),
+	document.NewSecret("cache_bucket", "drone", "cache-bucket"),
+	document.NewSecret("cache_gcs_json_key", "drone", "cache-gcs-json-key"),
+	document.NewSecret("cache_azure_account_name", "drone", "cache-azure-account-name"),
+	document.NewSecret("cache_azure_account_key", "drone", "cache-azure-account-key"),
 }
 
-type stage struct {
-	Name  string                   `yaml:"name"`
-	Kind  string                   `yaml:"kind,omitempty"`
-	Steps []map[string]interface{} `yaml:"steps,omitempty"`
-	Cache []cache                  `yaml:"cache,omitempty"`
-	Attrs map[string]interface{}   `yaml:",inline"`
+// decode returns the cache block of a pipeline, or nil
+func decode(doc *document.Document) ([]cache, error) {
+	block := document.Lookup(doc.Root(), "cache")
+	if block == nil {
+		return nil, nil
+	}
+	caches := []cache{}
+	if err := block.Decode(&caches); err != nil {
+		return nil, err
+	}
+	return caches, nil
 }
 
-func (s *stage) update() bool {
-	if s.Kind != "pipeline" || len(s.Cache) == 0 {
-		return false
+// cacheLine returns the line of the cache key in a pipeline
+func cacheLine(doc *document.Document) int {
+	if key := document.LookupKey(doc.Root(), "cache"); key != nil {
+		return key.Line
 	}
-	restoreSteps := []map[string]interface{}{}
-	storeSteps := []map[string]interface{}{}
-	for _, c := range s.Cache {
+	return doc.Line()
+}
+
+// update replaces the cache block of a pipeline with restore and
+// upload steps
+func (p *plugin) update(doc *document.Document, caches []cache, used document.Secrets) error {
+	root := doc.Root()
+	restoreSteps := []*yaml.Node{}
+	storeSteps := []*yaml.Node{}
+	volumes := []*yaml.Node{}
+	for _, c := range caches {
 		if c.Path == "" {
 			// skip things where we don't have the two required entry
 			continue
@@ -41,138 +90,158 @@ func (s *stage) update() bool {
 		if ttl <= 0 {
 			ttl = 5 // days
 		}
-		restoreSteps = append(restoreSteps, map[string]interface{}{
-			"name":  fmt.Sprintf("Restoring cached path '%s'", c.Path),
-			"image": "andrewstucki/s3-cache",
-			"settings": map[string]interface{}{
-				"pull":    true,
-				"restore": true,
-				"hash":    c.Hash,
-				"root": map[string]interface{}{
-					"from_secret": "cache_bucket",
-				},
-				"access_key": map[string]interface{}{
-					"from_secret": "cache_access_key",
-				},
-				"secret_key": map[string]interface{}{
-					"from_secret": "cache_secret_key",
-				},
-			},
-		})
+		storage, err := p.storage(c)
+		if err != nil {
+			return err
+		}
+		restore := storage.step(c, false, used)
+		restore.Name = fmt.Sprintf("Restoring cached path '%s'", c.Path)
+		node, err := document.Encode(restore)
+		if err != nil {
+			return err
+		}
+		document.Mark(node, name)
+		restoreSteps = append(restoreSteps, node)
+
 		// the rebuild step
-		storeSteps = append(storeSteps, map[string]interface{}{
-			"name":  fmt.Sprintf("Uploading cached path '%s'", c.Path),
-			"image": "andrewstucki/s3-cache",
-			"settings": map[string]interface{}{
-				"pull":    true,
-				"rebuild": true,
-				"hash":    c.Hash,
-				"mount":   []string{c.Path},
-				"root": map[string]interface{}{
-					"from_secret": "cache_bucket",
-				},
-				"access_key": map[string]interface{}{
-					"from_secret": "cache_access_key",
-				},
-				"secret_key": map[string]interface{}{
-					"from_secret": "cache_secret_key",
-				},
-			},
-		})
+		rebuild := storage.step(c, true, used)
+		rebuild.Name = fmt.Sprintf("Uploading cached path '%s'", c.Path)
+		node, err = document.Encode(rebuild)
+		if err != nil {
+			return err
+		}
+		document.Mark(node, name)
+		storeSteps = append(storeSteps, node)
+
+		if v := storage.volume(); v != nil && len(volumes) == 0 {
+			node, err := document.Encode(v)
+			if err != nil {
+				return err
+			}
+			document.Mark(node, name)
+			volumes = append(volumes, node)
+		}
 	}
 
+	steps := document.Ensure(root, "steps", yaml.SequenceNode)
+	// replace the steps generated by an earlier conversion
+	document.RemoveMarked(steps, name)
 	// append the restore steps onto the beginning of the steps
-	s.Steps = append(restoreSteps, s.Steps...)
+	steps.Content = append(restoreSteps, steps.Content...)
 	// append the store steps onto the end of the steps
-	s.Steps = append(s.Steps, storeSteps...)
+	steps.Content = append(steps.Content, storeSteps...)
+
+	// replace the volume added by an earlier conversion
+	if node := document.Lookup(root, "volumes"); node != nil {
+		document.RemoveMarked(node, name)
+	}
+	if len(volumes) > 0 {
+		node := document.Ensure(root, "volumes", yaml.SequenceNode)
+		node.Content = append(node.Content, volumes...)
+	}
 
 	// clear out the cache
-	s.Cache = []cache{}
+	document.Delete(root, "cache")
+	doc.Touch()
+
+	return nil
+}
+
+// Option configures the conversion plugin
+type Option func(*plugin)
+
+// WithBackend sets the backend of the caches that do not name one, S3
+// by default
+func WithBackend(backend Backend) Option {
+	return func(p *plugin) {
+		p.backend = backend
+	}
+}
+
+// WithEndpoint sets the endpoint of the minio backend for the caches
+// that do not set one
+func WithEndpoint(endpoint string) Option {
+	return func(p *plugin) {
+		p.endpoint = endpoint
+	}
+}
 
-	return true
+// WithVolume sets the host directory of the volume backend
+func WithVolume(path string) Option {
+	return func(p *plugin) {
+		if path != "" {
+			p.volume = path
+		}
+	}
 }
 
 // New returns a new conversion plugin.
-func New() converter.Plugin {
-	return &plugin{}
+func New(options ...Option) chain.Converter {
+	p := &plugin{
+		backend: BackendS3,
+		volume:  defaultVolume,
+	}
+	for _, option := range options {
+		option(p)
+	}
+	return p
+}
+
+type plugin struct {
+	backend  Backend
+	endpoint string
+	volume   string
 }
 
-type plugin struct{}
+// Name returns the name of the converter
+func (p *plugin) Name() string {
+	return name
+}
 
 // Convert adds caching steps to the configuration
 func (p *plugin) Convert(ctx context.Context, req *converter.Request) (*drone.Config, error) {
-	stages := []*stage{}
-
-	decoder := yaml.NewDecoder(bytes.NewBuffer([]byte(req.Config.Data)))
-	for {
-		stage := new(stage)
-		err := decoder.Decode(stage)
-		if err == io.EOF {
-			break
-		}
+	return chain.Apply(ctx, req, p)
+}
+
+// ConvertConfig adds caching steps to the parsed configuration
+func (p *plugin) ConvertConfig(ctx context.Context, req *converter.Request, config *document.Config) error {
+	used := document.Secrets{}
+	for _, doc := range config.Pipelines() {
+		caches, err := decode(doc)
 		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"build_id":       req.Build.ID,
-				"repo_namespace": req.Repo.Namespace,
-				"repo_name":      req.Repo.Name,
-			}).Errorln(err)
-			return nil, nil
+			converterErr := chain.DecodeError(name, req.Repo.Config, err)
+			converterErr.Pipeline = doc.Name()
+			return converterErr
 		}
-		stages = append(stages, stage)
-	}
-
-	for _, s := range stages {
-		if s.update() {
-			logrus.WithFields(logrus.Fields{
-				"build_id":       req.Build.ID,
-				"repo_namespace": req.Repo.Namespace,
-				"repo_name":      req.Repo.Name,
-				"stage_name":     s.Name,
-			}).Debugln("updated cache settings for stage")
+		if caches == nil {
+			continue
+		}
+		line := cacheLine(doc)
+		if err := p.update(doc, caches, used); err != nil {
+			return &chain.Error{
+				Kind:      chain.ErrInvalid,
+				Converter: name,
+				File:      req.Repo.Config,
+				Line:      line,
+				Pipeline:  doc.Name(),
+				Err:       err,
+			}
 		}
+		logrus.WithFields(logrus.Fields{
+			"build_id":       req.Build.ID,
+			"repo_namespace": req.Repo.Namespace,
+			"repo_name":      req.Repo.Name,
+			"stage_name":     doc.Name(),
+		}).Debugln("updated cache settings for stage")
 	}
 
-	stages = append(stages, &stage{
-		Name: "cache_access_key",
-		Kind: "secret",
-		Attrs: map[string]interface{}{
-			"get": map[string]interface{}{
-				"path": "drone",
-				"name": "cache-access-key",
-			},
-		},
-	}, &stage{
-		Name: "cache_secret_key",
-		Kind: "secret",
-		Attrs: map[string]interface{}{
-			"get": map[string]interface{}{
-				"path": "drone",
-				"name": "cache-secret-key",
-			},
-		},
-	}, &stage{
-		Name: "cache_bucket",
-		Kind: "secret",
-		Attrs: map[string]interface{}{
-			"get": map[string]interface{}{
-				"path": "drone",
-				"name": "cache-bucket",
-			},
-		},
-	})
-	buffer := new(bytes.Buffer)
-	encoder := yaml.NewEncoder(buffer)
-	for _, s := range stages {
-		if err := encoder.Encode(s); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"build_id":       req.Build.ID,
-				"repo_namespace": req.Repo.Namespace,
-				"repo_name":      req.Repo.Name,
-			}).Errorln(err)
-			return nil, nil
+	if err := config.AppendSecrets(name, used, secrets...); err != nil {
+		return &chain.Error{
+			Kind:      chain.ErrEncode,
+			Converter: name,
+			File:      req.Repo.Config,
+			Err:       err,
 		}
 	}
-	return &drone.Config{
-		Data: buffer.String(),
-	}, nil
+	return nil
 }
@@ -2,10 +2,12 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"testing"
 
+	"github.com/andrewstucki/drone-infrastructure-plugin/chain"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/converter"
 	"github.com/stretchr/testify/require"
@@ -19,6 +21,10 @@ func TestPlugin(t *testing.T) {
 	}{
 		{"vanilla"},
 		{"pipeline"},
+		{"anchors"},
+		{"secrets"},
+		{"reconverted"},
+		{"backends"},
 	}
 	for _, test := range tests {
 		t.Run(test.file, func(t *testing.T) {
@@ -48,6 +54,101 @@ func TestPlugin(t *testing.T) {
 			require.NoError(t, err)
 			require.NotNil(t, config)
 			require.Equal(t, string(after), config.Data)
+
+			// converting the output again must leave it unchanged
+			req.Config.Data = config.Data
+			config, err = New().Convert(noContext, req)
+			require.NoError(t, err)
+			require.NotNil(t, config)
+			require.Equal(t, string(after), config.Data)
 		})
 	}
 }
+
+func TestPluginMalformed(t *testing.T) {
+	before, err := ioutil.ReadFile("testdata/malformed.yml")
+	require.NoError(t, err)
+
+	req := &converter.Request{
+		Repo: drone.Repo{
+			Slug:   "octocat/hello-world",
+			Config: ".drone.yml",
+		},
+		Config: drone.Config{
+			Data: string(before),
+		},
+	}
+
+	config, err := New().Convert(noContext, req)
+	require.Nil(t, config)
+	require.Error(t, err)
+
+	var converterErr *chain.Error
+	require.True(t, errors.As(err, &converterErr))
+	require.Equal(t, chain.ErrDecode, converterErr.Kind)
+	require.Equal(t, "cache", converterErr.Converter)
+	require.Equal(t, 5, converterErr.Line)
+}
+
+func TestPluginDefaultBackend(t *testing.T) {
+	req := &converter.Request{
+		Repo: drone.Repo{Config: ".drone.yml"},
+		Config: drone.Config{
+			Data: "kind: pipeline\nname: default\ncache:\n  - path: vendor\n  - path: node_modules\n    backend: s3\n",
+		},
+	}
+	config, err := New(WithBackend(BackendMinIO), WithEndpoint("https://minio.example.com")).Convert(noContext, req)
+	require.NoError(t, err)
+	require.Contains(t, config.Data, "endpoint: https://minio.example.com")
+	require.Contains(t, config.Data, "image: "+pluginImage)
+	require.Contains(t, config.Data, "image: "+s3CacheImage)
+
+	config, err = New(WithBackend(BackendVolume), WithVolume("/mnt/cache")).Convert(noContext, req)
+	require.NoError(t, err)
+	require.Contains(t, config.Data, "filesystem_cache_root: /mnt/cache")
+}
+
+func TestPluginInvalidBackend(t *testing.T) {
+	tests := []struct {
+		name  string
+		cache string
+		err   string
+	}{
+		{"unknown", "backend: floppy", `unknown cache backend "floppy"`},
+		{"endpoint", "backend: minio", "the minio cache backend is missing an endpoint"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &converter.Request{
+				Repo: drone.Repo{Config: ".drone.yml"},
+				Config: drone.Config{
+					Data: "kind: pipeline\nname: invalid\ncache:\n  - path: vendor\n    " + test.cache + "\n",
+				},
+			}
+			_, err := New().Convert(noContext, req)
+			var converterErr *chain.Error
+			require.True(t, errors.As(err, &converterErr))
+			require.Equal(t, chain.ErrInvalid, converterErr.Kind)
+			require.Equal(t, "invalid", converterErr.Pipeline)
+			require.Equal(t, 3, converterErr.Line)
+			require.EqualError(t, converterErr.Err, test.err)
+		})
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	for input, expected := range map[string]Backend{
+		"":              BackendS3,
+		"S3":            BackendS3,
+		"s3-compatible": BackendMinIO,
+		"gcs":           BackendGCS,
+		"azure":         BackendAzure,
+		"volume":        BackendVolume,
+	} {
+		backend, err := ParseBackend(input)
+		require.NoError(t, err)
+		require.Equal(t, expected, backend)
+	}
+	_, err := ParseBackend("floppy")
+	require.Error(t, err)
+}
@@ -0,0 +1,263 @@
+package chain
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+	"github.com/sirupsen/logrus"
+)
+
+// cacheMetrics publishes the conversion cache counters of every
+// cache in the process on the expvar endpoint
+var cacheMetrics = expvar.NewMap("convert_cache")
+
+// CacheStats are the counters of a ResultCache
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+type cacheEntry struct {
+	Key     string       `json:"key"`
+	Config  drone.Config `json:"config"`
+	Expires time.Time    `json:"expires"`
+}
+
+// ResultCache is a least recently used cache of conversion results,
+// keyed by the repository, the commits of the build, the event and a
+// hash of the configuration. When a directory is given the entries
+// are also written to disk so that they survive restarts.
+type ResultCache struct {
+	size     int
+	ttl      time.Duration
+	dir      string
+	settings string
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// NewResultCache returns a cache holding up to size results for the ttl,
+// an empty dir keeps the cache in memory only
+func NewResultCache(size int, ttl time.Duration, dir string) (*ResultCache, error) {
+	c := &ResultCache{
+		size:    size,
+		ttl:     ttl,
+		dir:     dir,
+		now:     time.Now,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WithSettings makes a fingerprint of the settings of the converters
+// part of the keys, so that the results persisted before a restart with
+// other settings are not served
+func (c *ResultCache) WithSettings(fingerprint string) *ResultCache {
+	c.settings = fingerprint
+	return c
+}
+
+// key returns the key of the conversion result for a request, the
+// target branch and the deployment environment are part of it since the
+// converters compare pull requests with their target and deployments
+// with the last one to the same environment
+func (c *ResultCache) key(req *converter.Request) string {
+	config := sha256.Sum256([]byte(req.Config.Data))
+	key := sha256.Sum256([]byte(strings.Join([]string{
+		c.settings,
+		req.Repo.Slug,
+		req.Build.Before,
+		req.Build.After,
+		req.Build.Event,
+		req.Build.Target,
+		req.Build.Deploy,
+		hex.EncodeToString(config[:]),
+	}, "\x00")))
+	return hex.EncodeToString(key[:])
+}
+
+// Get returns the cached conversion result for the key
+func (c *ResultCache) Get(key string) (*drone.Config, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if ok {
+		entry := element.Value.(*cacheEntry)
+		if c.now().Before(entry.Expires) {
+			c.order.MoveToFront(element)
+			c.count(&c.hits, "hits")
+			config := entry.Config
+			return &config, true
+		}
+		c.remove(element)
+	}
+	c.count(&c.misses, "misses")
+	return nil, false
+}
+
+// Add stores the conversion result for the key
+func (c *ResultCache) Add(key string, config *drone.Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	entry := &cacheEntry{
+		Key:     key,
+		Config:  *config,
+		Expires: c.now().Add(c.ttl),
+	}
+	c.insert(entry)
+	if err := c.write(entry); err != nil {
+		logrus.WithError(err).Warnln("cannot persist conversion result")
+	}
+}
+
+// Stats returns the counters of the cache
+func (c *ResultCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Evictions: atomic.LoadInt64(&c.evictions),
+	}
+}
+
+func (c *ResultCache) count(counter *int64, name string) {
+	atomic.AddInt64(counter, 1)
+	cacheMetrics.Add(name, 1)
+}
+
+// insert adds the entry as the most recently used, evicting the
+// least recently used entries over the size limit
+func (c *ResultCache) insert(entry *cacheEntry) {
+	c.entries[entry.Key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.count(&c.evictions, "evictions")
+	}
+}
+
+func (c *ResultCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.Key)
+	if c.dir != "" {
+		os.Remove(c.path(entry.Key))
+	}
+}
+
+func (c *ResultCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// write persists the entry, through a temporary file so that a
+// partially written entry is never read back
+func (c *ResultCache) write(entry *cacheEntry) error {
+	if c.dir == "" {
+		return nil
+	}
+	if _, ok := c.entries[entry.Key]; !ok {
+		// evicted straight away
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(c.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), c.path(entry.Key))
+}
+
+// load reads the persisted entries back, dropping the ones that have
+// expired and the oldest ones over the size limit
+func (c *ResultCache) load() error {
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	entries := []*cacheEntry{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		entry := &cacheEntry{}
+		if err := json.Unmarshal(data, entry); err != nil || !c.now().Before(entry.Expires) {
+			os.Remove(file)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	// insert the oldest first so that they are the first evicted
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Expires.Before(entries[j].Expires)
+	})
+	for _, entry := range entries {
+		c.insert(entry)
+	}
+	return nil
+}
+
+type degradedKey struct{}
+
+// withDegraded returns a context through which converters can report
+// that their result is degraded
+func withDegraded(ctx context.Context) (context.Context, *int32) {
+	degraded := new(int32)
+	return context.WithValue(ctx, degradedKey{}, degraded), degraded
+}
+
+// Degrade records that the result of the conversion is degraded, for
+// example by a converter that fell back to running every pipeline
+// after a transient error, or depends on more than the request, like
+// the build history, so that the result is not cached
+func Degrade(ctx context.Context) {
+	if degraded, ok := ctx.Value(degradedKey{}).(*int32); ok {
+		atomic.StoreInt32(degraded, 1)
+	}
+}
@@ -0,0 +1,172 @@
+package chain
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+	"github.com/stretchr/testify/require"
+)
+
+func counting(calls *int) converter.Plugin {
+	return convertFunc(func(ctx context.Context, req *converter.Request) (*drone.Config, error) {
+		*calls++
+		return &drone.Config{Data: req.Config.Data + "-converted"}, nil
+	})
+}
+
+func cacheRequest(after, data string) *converter.Request {
+	return &converter.Request{
+		Repo:   drone.Repo{Slug: "octocat/hello-world"},
+		Build:  drone.Build{After: after, Event: "push"},
+		Config: drone.Config{Data: data},
+	}
+}
+
+func TestConvertCache(t *testing.T) {
+	cache, err := NewResultCache(10, time.Hour, "")
+	require.NoError(t, err)
+	calls := 0
+	plugin := New().
+		WithConverters([]converter.Plugin{counting(&calls)}).
+		WithCache(cache)
+
+	for i := 0; i < 2; i++ {
+		config, err := plugin.Convert(noContext, cacheRequest("a", "original"))
+		require.NoError(t, err)
+		require.Equal(t, "original-converted", config.Data)
+	}
+	require.Equal(t, 1, calls)
+
+	// a different commit or configuration is converted again
+	_, err = plugin.Convert(noContext, cacheRequest("b", "original"))
+	require.NoError(t, err)
+	_, err = plugin.Convert(noContext, cacheRequest("a", "changed"))
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	// so is a promotion of the commit to another environment
+	promote := func(deploy string) *converter.Request {
+		req := cacheRequest("a", "original")
+		req.Build.Event = drone.EventPromote
+		req.Build.Deploy = deploy
+		return req
+	}
+	_, err = plugin.Convert(noContext, promote("staging"))
+	require.NoError(t, err)
+	_, err = plugin.Convert(noContext, promote("production"))
+	require.NoError(t, err)
+	require.Equal(t, 5, calls)
+	require.Equal(t, CacheStats{Hits: 1, Misses: 5}, cache.Stats())
+}
+
+func TestConvertCacheSkipsDegraded(t *testing.T) {
+	cache, err := NewResultCache(10, time.Hour, "")
+	require.NoError(t, err)
+	plugin := New().
+		WithConverters([]converter.Plugin{failing("broken")}).
+		WithErrorPolicy(PolicySkip, nil).
+		WithCache(cache)
+
+	for i := 0; i < 2; i++ {
+		_, err := plugin.Convert(noContext, cacheRequest("a", "original"))
+		require.NoError(t, err)
+	}
+	require.Equal(t, CacheStats{Misses: 2}, cache.Stats())
+}
+
+func TestConvertCacheSkipsDegradedConverter(t *testing.T) {
+	cache, err := NewResultCache(10, time.Hour, "")
+	require.NoError(t, err)
+	calls := 0
+	plugin := New().
+		WithConverters([]converter.Plugin{convertFunc(func(ctx context.Context, req *converter.Request) (*drone.Config, error) {
+			calls++
+			Degrade(ctx)
+			return &drone.Config{Data: req.Config.Data + "-fallback"}, nil
+		})}).
+		WithCache(cache)
+
+	for i := 0; i < 2; i++ {
+		config, err := plugin.Convert(noContext, cacheRequest("a", "original"))
+		require.NoError(t, err)
+		require.Equal(t, "original-fallback", config.Data)
+	}
+	require.Equal(t, 2, calls)
+	require.Equal(t, CacheStats{Misses: 2}, cache.Stats())
+}
+
+func TestResultCacheLimits(t *testing.T) {
+	cache, err := NewResultCache(2, time.Minute, "")
+	require.NoError(t, err)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.Add("a", &drone.Config{Data: "a"})
+	cache.Add("b", &drone.Config{Data: "b"})
+	_, ok := cache.Get("a")
+	require.True(t, ok)
+	// b is the least recently used
+	cache.Add("c", &drone.Config{Data: "c"})
+	_, ok = cache.Get("b")
+	require.False(t, ok)
+
+	now = now.Add(2 * time.Minute)
+	_, ok = cache.Get("a")
+	require.False(t, ok)
+	require.Equal(t, CacheStats{Hits: 1, Misses: 2, Evictions: 1}, cache.Stats())
+}
+
+func TestConvertCacheSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convert-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	calls := 0
+	convert := func(settings string) {
+		cache, err := NewResultCache(10, time.Hour, dir)
+		require.NoError(t, err)
+		plugin := New().
+			WithConverters([]converter.Plugin{counting(&calls)}).
+			WithCache(cache.WithSettings(settings))
+		_, err = plugin.Convert(noContext, cacheRequest("a", "original"))
+		require.NoError(t, err)
+	}
+	// the results persisted with other settings are converted again
+	convert("v1")
+	convert("v1")
+	require.Equal(t, 1, calls)
+	convert("v2")
+	require.Equal(t, 2, calls)
+}
+
+func TestResultCachePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "convert-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := NewResultCache(2, time.Hour, dir)
+	require.NoError(t, err)
+	cache.Add("a", &drone.Config{Data: "a"})
+	cache.Add("b", &drone.Config{Data: "b"})
+	cache.Add("c", &drone.Config{Data: "c"})
+
+	reloaded, err := NewResultCache(2, time.Hour, dir)
+	require.NoError(t, err)
+	_, ok := reloaded.Get("a")
+	require.False(t, ok)
+	config, ok := reloaded.Get("c")
+	require.True(t, ok)
+	require.Equal(t, "c", config.Data)
+
+	// expired entries are not returned
+	expired, err := NewResultCache(2, time.Hour, dir)
+	require.NoError(t, err)
+	expired.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, ok = expired.Get("c")
+	require.False(t, ok)
+}
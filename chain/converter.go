@@ -0,0 +1,75 @@
+package chain
+
+import (
+	"context"
+	"errors"
+
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+)
+
+// Converter is a converter plugin that mutates a configuration that
+// has already been parsed, allowing the chain to parse and serialize
+// the yaml only once for all of its converters
+type Converter interface {
+	converter.Plugin
+
+	// Name returns the name used to refer to the converter in policies
+	Name() string
+	// ConvertConfig modifies the parsed configuration in place
+	ConvertConfig(ctx context.Context, req *converter.Request, config *document.Config) error
+}
+
+// parse parses the request configuration, wrapping any syntax errors
+func parse(name string, req *converter.Request) (*document.Config, error) {
+	config, err := document.Parse(req.Config.Data)
+	if err != nil {
+		line := 0
+		var parseErr *document.ParseError
+		if errors.As(err, &parseErr) {
+			line = parseErr.Line
+		}
+		return nil, &Error{
+			Kind:      ErrDecode,
+			Converter: name,
+			File:      req.Repo.Config,
+			Line:      line,
+			Err:       err,
+		}
+	}
+	return config, nil
+}
+
+// serialize encodes the configuration, wrapping any errors
+func serialize(name string, req *converter.Request, config *document.Config) (string, error) {
+	data, err := config.String()
+	if err != nil {
+		return "", &Error{
+			Kind:      ErrEncode,
+			Converter: name,
+			File:      req.Repo.Config,
+			Err:       err,
+		}
+	}
+	return data, nil
+}
+
+// Apply runs a single converter against the request configuration, it
+// is used by converters to implement converter.Plugin
+func Apply(ctx context.Context, req *converter.Request, c Converter) (*drone.Config, error) {
+	config, err := parse(c.Name(), req)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ConvertConfig(ctx, req, config); err != nil {
+		return nil, err
+	}
+	data, err := serialize(c.Name(), req, config)
+	if err != nil {
+		return nil, err
+	}
+	return &drone.Config{
+		Data: data,
+	}, nil
+}
@@ -0,0 +1,136 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrorKind classifies the errors returned by converters
+type ErrorKind int
+
+const (
+	// ErrDecode is returned when the configuration cannot be parsed
+	ErrDecode ErrorKind = iota
+	// ErrEncode is returned when the converted configuration cannot be serialized
+	ErrEncode
+	// ErrSCM is returned when the source control provider cannot be queried
+	ErrSCM
+	// ErrInvalid is returned when an extension block in the configuration is malformed
+	ErrInvalid
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrDecode:
+		return "cannot parse configuration"
+	case ErrEncode:
+		return "cannot serialize configuration"
+	case ErrSCM:
+		return "cannot query source control"
+	case ErrInvalid:
+		return "invalid configuration"
+	}
+	return "unknown error"
+}
+
+// Error is a converter error carrying enough context to be reported
+// back to the user as a build error
+type Error struct {
+	Kind      ErrorKind
+	Converter string
+	File      string
+	Line      int
+	Pipeline  string
+	Err       error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.Converter != "" {
+		b.WriteString(e.Converter)
+		b.WriteString(": ")
+	}
+	if e.File != "" {
+		b.WriteString(e.File)
+		if e.Line > 0 {
+			b.WriteString(":")
+			b.WriteString(strconv.Itoa(e.Line))
+		}
+		b.WriteString(": ")
+	}
+	if e.Pipeline != "" {
+		fmt.Fprintf(&b, "pipeline %q: ", e.Pipeline)
+	}
+	b.WriteString(e.Kind.String())
+	if e.Err != nil {
+		b.WriteString(": ")
+		b.WriteString(e.Err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+var lineExpr = regexp.MustCompile(`line (\d+)`)
+
+// DecodeError wraps a yaml decoding error, extracting the line number
+// reported by the parser if there is one
+func DecodeError(converter, file string, err error) *Error {
+	line := 0
+	if match := lineExpr.FindStringSubmatch(err.Error()); match != nil {
+		line, _ = strconv.Atoi(match[1])
+	}
+	return &Error{
+		Kind:      ErrDecode,
+		Converter: converter,
+		File:      file,
+		Line:      line,
+		Err:       err,
+	}
+}
+
+// Policy determines how the chain reacts to an error from a converter
+type Policy int
+
+const (
+	// PolicyFail fails the build with the converter error
+	PolicyFail Policy = iota
+	// PolicySkip skips the failing converter and continues down the chain
+	PolicySkip
+	// PolicyPassThrough abandons the chain and returns the original configuration
+	PolicyPassThrough
+)
+
+// ParsePolicy parses a policy name
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "fail":
+		return PolicyFail, nil
+	case "skip":
+		return PolicySkip, nil
+	case "passthrough", "pass-through":
+		return PolicyPassThrough, nil
+	}
+	return PolicyFail, fmt.Errorf("unknown error policy %q", s)
+}
+
+func (p *ChainedPlugin) policyFor(err error) Policy {
+	var converterErr *Error
+	if errors.As(err, &converterErr) {
+		return p.policyForName(converterErr.Converter)
+	}
+	return p.policy
+}
+
+func (p *ChainedPlugin) policyForName(name string) Policy {
+	if policy, ok := p.policies[name]; ok {
+		return policy
+	}
+	return p.policy
+}
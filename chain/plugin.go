@@ -3,7 +3,10 @@ package chain
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
+	"time"
 
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/admission"
 	"github.com/drone/drone-go/plugin/converter"
@@ -14,6 +17,11 @@ import (
 // ChainedPlugin allows you to chain drone plugins
 type ChainedPlugin struct {
 	converters []converter.Plugin
+	policy     Policy
+	policies   map[string]Policy
+	rules      map[string]Rule
+	cache      *ResultCache
+	timeout    time.Duration
 	admit      []admission.Plugin
 	secrets    []secret.Plugin
 }
@@ -29,19 +37,144 @@ func (p *ChainedPlugin) WithConverters(converters []converter.Plugin) *ChainedPl
 	return p
 }
 
-// Convert calls all of the convert plugins that are chained
+// WithErrorPolicy sets how converter errors are handled, overrides are keyed by converter name
+func (p *ChainedPlugin) WithErrorPolicy(policy Policy, overrides map[string]Policy) *ChainedPlugin {
+	p.policy = policy
+	p.policies = overrides
+	return p
+}
+
+// WithCache reuses the conversion results of earlier requests for the
+// same repository, commits, event and configuration
+func (p *ChainedPlugin) WithCache(cache *ResultCache) *ChainedPlugin {
+	p.cache = cache
+	return p
+}
+
+// WithTimeout bounds the time spent converting a configuration, it
+// should be shorter than the timeout of the requests made by drone so
+// that converters retrying failed requests give up before drone does
+func (p *ChainedPlugin) WithTimeout(timeout time.Duration) *ChainedPlugin {
+	p.timeout = timeout
+	return p
+}
+
+// Convert calls all of the convert plugins that are chained, the configuration
+// is parsed once and shared between all of the converters implementing Converter
 func (p *ChainedPlugin) Convert(ctx context.Context, req *converter.Request) (*drone.Config, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	if p.cache == nil {
+		config, _, err := p.convert(ctx, req)
+		return config, err
+	}
+	key := p.cache.key(req)
+	if config, ok := p.cache.Get(key); ok {
+		logrus.WithFields(logrus.Fields{
+			"build_id":       req.Build.ID,
+			"repo_namespace": req.Repo.Namespace,
+			"repo_name":      req.Repo.Name,
+		}).Debugln("using cached conversion result")
+		return config, nil
+	}
+	ctx, degraded := withDegraded(ctx)
+	config, complete, err := p.convert(ctx, req)
+	if err == nil && complete && atomic.LoadInt32(degraded) == 0 && config != nil {
+		p.cache.Add(key, config)
+	}
+	return config, err
+}
+
+// convert runs the converters, it returns whether every converter
+// succeeded so that results degraded by the error policy are not cached
+func (p *ChainedPlugin) convert(ctx context.Context, req *converter.Request) (*drone.Config, bool, error) {
+	original := req.Config
+	complete := true
+	logger := logrus.WithFields(logrus.Fields{
+		"build_id":       req.Build.ID,
+		"repo_namespace": req.Repo.Namespace,
+		"repo_name":      req.Repo.Name,
+	})
+
+	// handle decides whether the chain can continue after a converter error
+	handle := func(err error) (*drone.Config, bool, error) {
+		complete = false
+		switch p.policyFor(err) {
+		case PolicySkip:
+			logger.WithError(err).Warnln("skipping failed converter")
+			return nil, true, nil
+		case PolicyPassThrough:
+			logger.WithError(err).Warnln("returning original configuration after converter failure")
+			return &original, false, nil
+		}
+		return nil, false, err
+	}
+
+	config, err := parse("", req)
+	if err != nil {
+		cfg, _, err := handle(err)
+		return cfg, complete, err
+	}
+	settings := parseHeader(req.Config.Data)
 	for _, c := range p.converters {
+		if c, ok := c.(Converter); ok {
+			if !p.enabled(c.Name(), req, settings) {
+				logger.WithField("converter", c.Name()).Debugln("converter disabled for repository")
+				continue
+			}
+			var snapshot *document.Config
+			if p.policyForName(c.Name()) == PolicySkip {
+				snapshot = config.Clone()
+			}
+			if err := c.ConvertConfig(ctx, req, config); err != nil {
+				cfg, next, err := handle(err)
+				if !next {
+					return cfg, complete, err
+				}
+				if snapshot != nil {
+					config = snapshot
+				}
+			}
+			continue
+		}
+
+		// plugins that only implement converter.Plugin get the
+		// serialized configuration and their output is parsed again
+		data, err := serialize("", req, config)
+		if err != nil {
+			return nil, false, err
+		}
+		req.Config = drone.Config{Data: data}
 		cfg, err := c.Convert(ctx, req)
 		if err != nil {
-			return nil, err
+			cfg, next, err := handle(err)
+			if !next {
+				return cfg, complete, err
+			}
+			continue
 		}
 		if cfg == nil {
-			return nil, nil
+			return nil, complete, nil
 		}
 		req.Config = *cfg
+		if config, err = parse("", req); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if !config.Modified() {
+		return &req.Config, complete, nil
+	}
+	data, err := serialize("", req, config)
+	if err != nil {
+		return nil, false, err
 	}
-	return &req.Config, nil
+	return &drone.Config{
+		Data: data,
+	}, complete, nil
 }
 
 // ConvertHandler wraps the plugin in a converter handler
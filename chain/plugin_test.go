@@ -0,0 +1,173 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+	"github.com/stretchr/testify/require"
+)
+
+var noContext = context.Background()
+
+type convertFunc func(ctx context.Context, req *converter.Request) (*drone.Config, error)
+
+func (f convertFunc) Convert(ctx context.Context, req *converter.Request) (*drone.Config, error) {
+	return f(ctx, req)
+}
+
+func appending(suffix string) converter.Plugin {
+	return convertFunc(func(ctx context.Context, req *converter.Request) (*drone.Config, error) {
+		return &drone.Config{Data: req.Config.Data + suffix}, nil
+	})
+}
+
+func failing(name string) converter.Plugin {
+	return convertFunc(func(ctx context.Context, req *converter.Request) (*drone.Config, error) {
+		return nil, &Error{
+			Kind:      ErrInvalid,
+			Converter: name,
+			File:      ".drone.yml",
+			Line:      3,
+			Pipeline:  "default",
+			Err:       errors.New("boom"),
+		}
+	})
+}
+
+func TestConvertErrorPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    Policy
+		overrides map[string]Policy
+		expected  string
+		err       string
+	}{
+		{"fail", PolicyFail, nil, "", `broken: .drone.yml:3: pipeline "default": invalid configuration: boom`},
+		{"skip", PolicySkip, nil, "original-a-b", ""},
+		{"passthrough", PolicyPassThrough, nil, "original", ""},
+		{"override", PolicyFail, map[string]Policy{"broken": PolicySkip}, "original-a-b", ""},
+		{"unrelated override", PolicyFail, map[string]Policy{"other": PolicySkip}, "", `broken: .drone.yml:3: pipeline "default": invalid configuration: boom`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plugin := New().
+				WithConverters([]converter.Plugin{appending("-a"), failing("broken"), appending("-b")}).
+				WithErrorPolicy(test.policy, test.overrides)
+
+			config, err := plugin.Convert(noContext, &converter.Request{
+				Config: drone.Config{Data: "original"},
+			})
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				require.Nil(t, config)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expected, config.Data)
+		})
+	}
+}
+
+func TestConvertTimeout(t *testing.T) {
+	plugin := New().
+		WithConverters([]converter.Plugin{convertFunc(func(ctx context.Context, req *converter.Request) (*drone.Config, error) {
+			deadline, ok := ctx.Deadline()
+			require.True(t, ok)
+			require.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+			return nil, nil
+		})}).
+		WithTimeout(time.Minute)
+	_, err := plugin.Convert(noContext, &converter.Request{})
+	require.NoError(t, err)
+}
+
+func TestDecodeError(t *testing.T) {
+	err := DecodeError("cache", ".drone.yml", errors.New("yaml: line 12: mapping values are not allowed in this context"))
+	require.Equal(t, 12, err.Line)
+	require.Equal(t, ErrDecode, err.Kind)
+	require.EqualError(t, err, "cache: .drone.yml:12: cannot parse configuration: yaml: line 12: mapping values are not allowed in this context")
+}
+
+func TestParsePolicy(t *testing.T) {
+	for input, expected := range map[string]Policy{
+		"":            PolicyFail,
+		"fail":        PolicyFail,
+		"Skip":        PolicySkip,
+		"passthrough": PolicyPassThrough,
+	} {
+		policy, err := ParsePolicy(input)
+		require.NoError(t, err)
+		require.Equal(t, expected, policy)
+	}
+	_, err := ParsePolicy("ignore")
+	require.Error(t, err)
+}
+
+type documentConverter struct {
+	name string
+	fn   func(config *document.Config) error
+}
+
+func (c *documentConverter) Name() string {
+	return c.name
+}
+
+func (c *documentConverter) Convert(ctx context.Context, req *converter.Request) (*drone.Config, error) {
+	return Apply(ctx, req, c)
+}
+
+func (c *documentConverter) ConvertConfig(ctx context.Context, req *converter.Request, config *document.Config) error {
+	return c.fn(config)
+}
+
+func setting(key, value string) *documentConverter {
+	return &documentConverter{name: key, fn: func(config *document.Config) error {
+		doc := config.Documents[0]
+		document.Set(doc.Root(), key, document.Scalar(value))
+		doc.Touch()
+		return nil
+	}}
+}
+
+func TestConvertDocuments(t *testing.T) {
+	const data = "kind: pipeline # comment\nname:   default\n---\nkind: secret\n"
+
+	untouched := &documentConverter{name: "noop", fn: func(config *document.Config) error {
+		return nil
+	}}
+	partial := &documentConverter{name: "partial", fn: func(config *document.Config) error {
+		doc := config.Documents[0]
+		document.Set(doc.Root(), "partial", document.Scalar("true"))
+		doc.Touch()
+		return &Error{Kind: ErrInvalid, Converter: "partial", Err: errors.New("boom")}
+	}}
+
+	tests := []struct {
+		name       string
+		converters []converter.Plugin
+		policies   map[string]Policy
+		expected   string
+	}{
+		{"untouched", []converter.Plugin{untouched}, nil, data},
+		{"shared", []converter.Plugin{setting("a", "1"), setting("b", "2")}, nil, "kind: pipeline # comment\nname: default\na: \"1\"\nb: \"2\"\n---\nkind: secret\n"},
+		{"mixed", []converter.Plugin{setting("a", "1"), appending("# appended\n")}, nil, "kind: pipeline # comment\nname: default\na: \"1\"\n---\nkind: secret\n# appended\n"},
+		{"skipped partial", []converter.Plugin{setting("a", "1"), partial}, map[string]Policy{"partial": PolicySkip}, "kind: pipeline # comment\nname: default\na: \"1\"\n---\nkind: secret\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plugin := New().
+				WithConverters(test.converters).
+				WithErrorPolicy(PolicyFail, test.policies)
+			config, err := plugin.Convert(noContext, &converter.Request{
+				Config: drone.Config{Data: data},
+			})
+			require.NoError(t, err)
+			require.Equal(t, test.expected, config.Data)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package chain
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/drone/drone-go/plugin/converter"
+)
+
+// headerPrefix is the comment prefix used to enable or disable
+// converters from within the configuration itself, for example:
+//
+//	# infrastructure: disable=deploy,cache
+//	# infrastructure: enable=paths
+const headerPrefix = "infrastructure:"
+
+// Rule restricts the repositories that a converter runs for
+type Rule struct {
+	// Repos are glob patterns matched against the repository slug
+	Repos []string
+	// Namespaces are the repository namespaces, i.e. owners, allowed
+	Namespaces []string
+	// OptIn requires the configuration header to enable the converter
+	OptIn bool
+}
+
+// match returns true if the rule allows the converter to run for the repository
+func (r Rule) match(req *converter.Request) bool {
+	if len(r.Repos) > 0 && !matchAny(req.Repo.Slug, r.Repos) {
+		return false
+	}
+	if len(r.Namespaces) > 0 && !matchAny(req.Repo.Namespace, r.Namespaces) {
+		return false
+	}
+	return true
+}
+
+func matchAny(s string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if match, _ := filepath.Match(pattern, s); match {
+			return true
+		}
+	}
+	return false
+}
+
+// header holds the converter settings found in the leading
+// comments of a configuration
+type header struct {
+	enabled  map[string]bool
+	disabled map[string]bool
+}
+
+// parseHeader reads the converter settings from the comments at the
+// top of the configuration, before any yaml content
+func parseHeader(data string) header {
+	h := header{
+		enabled:  map[string]bool{},
+		disabled: map[string]bool{},
+	}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "---") {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		if !strings.HasPrefix(line, headerPrefix) {
+			continue
+		}
+		for _, setting := range strings.Fields(strings.TrimPrefix(line, headerPrefix)) {
+			parts := strings.SplitN(setting, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			var names map[string]bool
+			switch parts[0] {
+			case "enable":
+				names = h.enabled
+			case "disable":
+				names = h.disabled
+			default:
+				continue
+			}
+			for _, name := range strings.Split(parts[1], ",") {
+				if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+					names[name] = true
+				}
+			}
+		}
+	}
+	return h
+}
+
+// WithRules restricts which converters run for a request, rules are keyed by converter name
+func (p *ChainedPlugin) WithRules(rules map[string]Rule) *ChainedPlugin {
+	p.rules = rules
+	return p
+}
+
+// enabled returns whether the named converter should run for the request
+func (p *ChainedPlugin) enabled(name string, req *converter.Request, h header) bool {
+	if h.disabled[name] || h.disabled["all"] {
+		return false
+	}
+	rule, ok := p.rules[name]
+	if !ok {
+		return true
+	}
+	if rule.OptIn && !h.enabled[name] {
+		return false
+	}
+	return rule.match(req)
+}
@@ -0,0 +1,63 @@
+package chain
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHeader(t *testing.T) {
+	h := parseHeader(`
+# infrastructure: disable=deploy,Cache
+# a regular comment
+---
+#infrastructure: enable=paths
+kind: pipeline
+# infrastructure: disable=paths
+`)
+	require.Equal(t, map[string]bool{"deploy": true, "cache": true}, h.disabled)
+	require.Equal(t, map[string]bool{"paths": true}, h.enabled)
+}
+
+func TestConvertRules(t *testing.T) {
+	const data = "kind: pipeline\nname:   default\n"
+
+	tests := []struct {
+		name     string
+		slug     string
+		data     string
+		rules    map[string]Rule
+		expected string
+	}{
+		{"no rules", "octocat/hello-world", data, nil, "kind: pipeline\nname: default\na: \"1\"\nb: \"2\"\n"},
+		{"repo glob", "octocat/hello-world", data, map[string]Rule{"a": {Repos: []string{"octocat/*"}}, "b": {Repos: []string{"acme/*"}}}, "kind: pipeline\nname: default\na: \"1\"\n"},
+		{"namespace", "acme/hello-world", data, map[string]Rule{"a": {Namespaces: []string{"octocat"}}}, "kind: pipeline\nname: default\nb: \"2\"\n"},
+		{"disabled in header", "octocat/hello-world", "# infrastructure: disable=a\n" + data, nil, "# infrastructure: disable=a\nkind: pipeline\nname: default\nb: \"2\"\n"},
+		{"all disabled in header", "octocat/hello-world", "# infrastructure: disable=all\n" + data, nil, "# infrastructure: disable=all\n" + data},
+		{"opt in", "octocat/hello-world", data, map[string]Rule{"a": {OptIn: true}, "b": {OptIn: true}}, data},
+		{"opted in", "octocat/hello-world", "# infrastructure: enable=b\n" + data, map[string]Rule{"a": {OptIn: true}, "b": {OptIn: true}}, "# infrastructure: enable=b\nkind: pipeline\nname: default\nb: \"2\"\n"},
+		{"opted in outside repos", "octocat/hello-world", "# infrastructure: enable=b\n" + data, map[string]Rule{"b": {OptIn: true, Repos: []string{"acme/*"}}}, "# infrastructure: enable=b\nkind: pipeline\nname: default\na: \"1\"\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plugin := New().
+				WithConverters([]converter.Plugin{setting("a", "1"), setting("b", "2")}).
+				WithRules(test.rules)
+
+			parts := strings.SplitN(test.slug, "/", 2)
+			config, err := plugin.Convert(noContext, &converter.Request{
+				Repo: drone.Repo{
+					Namespace: parts[0],
+					Name:      parts[1],
+					Slug:      test.slug,
+				},
+				Config: drone.Config{Data: test.data},
+			})
+			require.NoError(t, err)
+			require.Equal(t, test.expected, config.Data)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andrewstucki/drone-infrastructure-plugin/chain"
+	"github.com/andrewstucki/drone-infrastructure-plugin/paths"
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+const convertUsage = `usage: drone-infrastructure-plugin convert [flags] [.drone.yml]
+
+Renders the configuration as the convert extension would for a build.
+Changed files come from -files, from the -git repository, or from the
+source control api configured with the DRONE_SCM_* settings.
+
+`
+
+// runConvert implements the convert subcommand
+func runConvert(ctx context.Context, spec *spec, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		io.WriteString(stdout, convertUsage)
+		flags.PrintDefaults()
+	}
+	var (
+		slug   = flags.String("repo", "octocat/hello-world", "repository slug")
+		event  = flags.String("event", drone.EventPush, "build event")
+		branch = flags.String("branch", "master", "build branch")
+		target = flags.String("target", "", "target branch of a pull request, defaults to -branch")
+		before = flags.String("before", "", "commit before the build")
+		after  = flags.String("after", "HEAD", "commit of the build")
+		files  = flags.String("files", "", "comma separated list of changed files")
+		git    = flags.String("git", "", "local git repository used to list the changed files")
+		diff   = flags.Bool("diff", false, "print a unified diff against the input")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *target == "" {
+		*target = *branch
+	}
+	file := ".drone.yml"
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		file = flags.Arg(0)
+	default:
+		flags.Usage()
+		return errors.New("too many arguments")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var provider paths.ChangedFilesProvider
+	switch {
+	case *files != "":
+		provider = paths.NewStaticProvider(strings.Split(*files, ",")...)
+	case *git != "":
+		provider = paths.NewGitRepository(*git)
+	default:
+		provider = setupSCMProvider(spec, setupGithubClient(spec, setupGithubApp(spec)))
+	}
+
+	namespace, name := *slug, ""
+	if parts := strings.SplitN(*slug, "/", 2); len(parts) == 2 {
+		namespace, name = parts[0], parts[1]
+	}
+	req := &converter.Request{
+		Build: drone.Build{
+			Event:  *event,
+			Before: *before,
+			After:  *after,
+			Source: *branch,
+			Target: *target,
+			Ref:    "refs/heads/" + *branch,
+		},
+		Repo: drone.Repo{
+			Namespace: namespace,
+			Name:      name,
+			Slug:      *slug,
+			Config:    file,
+		},
+		Config: drone.Config{
+			Data: string(data),
+		},
+	}
+	plugin := chain.New().
+		WithConverters(setupConvert(spec, provider, nil)).
+		WithErrorPolicy(setupErrorPolicy(spec)).
+		WithRules(setupRules(spec))
+	config, err := plugin.Convert(ctx, req)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return errors.New("the configuration was rejected")
+	}
+
+	if !*diff {
+		_, err := io.WriteString(stdout, config.Data)
+		return err
+	}
+	return difflib.WriteUnifiedDiff(stdout, difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(data)),
+		B:        difflib.SplitLines(config.Data),
+		FromFile: file,
+		ToFile:   file + " (converted)",
+		Context:  3,
+	})
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/andrewstucki/drone-infrastructure-plugin/cache"
@@ -31,9 +36,9 @@ type compareCommitsResponse struct {
 
 func makeCommitFiles(paths []string) []github.CommitFile {
 	files := []github.CommitFile{}
-	for _, p := range paths {
+	for i := range paths {
 		files = append(files, github.CommitFile{
-			Filename: &p,
+			Filename: &paths[i],
 		})
 	}
 	return files
@@ -98,22 +103,104 @@ func TestPlugin(t *testing.T) {
 			if test.commitResponse != nil {
 				client.EXPECT().
 					GetCommit(noContext, repo.Namespace, repo.Name, build.After).
-					Return(test.commitResponse.commit, nil, test.commitResponse.err)
+					Return(test.commitResponse.commit, nil, test.commitResponse.err).
+					Times(2)
 			}
 			if test.diffResponse != nil {
 				client.EXPECT().
 					CompareCommits(noContext, repo.Namespace, repo.Name, build.Before, build.After).
-					Return(test.diffResponse.diff, nil, test.diffResponse.err)
+					Return(test.diffResponse.diff, nil, test.diffResponse.err).
+					Times(2)
 			}
 			plugin := chain.New().WithConverters([]converter.Plugin{
 				cache.New(),
-				paths.New(client),
+				paths.New(paths.NewGithubProvider(client)),
 				deploy.New(),
 			})
 			config, err := plugin.Convert(noContext, req)
 			require.NoError(t, err)
 			require.NotNil(t, config)
 			require.Equal(t, string(after), config.Data)
+
+			// converting the output again must leave it unchanged
+			req.Config.Data = config.Data
+			config, err = plugin.Convert(noContext, req)
+			require.NoError(t, err)
+			require.NotNil(t, config)
+			require.Equal(t, string(after), config.Data)
 		})
 	}
 }
+
+func TestConvertCommand(t *testing.T) {
+	after, err := ioutil.ReadFile("testdata/pipeline.yml.golden")
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	err = runConvert(noContext, &spec{}, []string{"-files", "README.md", "testdata/pipeline.yml"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, string(after), out.String())
+
+	out.Reset()
+	err = runConvert(noContext, &spec{}, []string{"-files", "README.md", "-diff", "testdata/pipeline.yml"}, &out)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(out.String(), "--- testdata/pipeline.yml\n+++ testdata/pipeline.yml (converted)\n"))
+}
+
+func TestConvertCommandTarget(t *testing.T) {
+	// a pull request from the feature branch changing the frontend
+	dir, err := ioutil.TempDir("", "convert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	git("init", "-q")
+	git("commit", "-q", "--allow-empty", "-m", "initial")
+	git("branch", "-M", "master")
+	git("checkout", "-q", "-b", "feature")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "client"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "client", "app.js"), nil, 0644))
+	git("add", "client/app.js")
+	git("commit", "-q", "-m", "frontend")
+
+	frontend := func(args ...string) string {
+		args = append([]string{"-git", dir, "-event", drone.EventPullRequest, "-branch", "feature", "-after", "feature"}, args...)
+		var out bytes.Buffer
+		require.NoError(t, runConvert(noContext, &spec{}, append(args, "testdata/pipeline.yml"), &out))
+		return strings.SplitN(out.String(), "\n---\n", 2)[0]
+	}
+	// the pull request is compared with its target branch
+	require.NotContains(t, frontend("-target", "master"), "exclude:")
+	// which defaults to the branch, leaving no changes
+	require.Contains(t, frontend(), "exclude:")
+}
+
+func TestConvertMain(t *testing.T) {
+	// runs the convert subcommand through main in a child process of the
+	// test, since main exits on errors
+	if os.Getenv("TEST_CONVERT_MAIN") == "1" {
+		os.Args = []string{"drone-infrastructure-plugin", "convert", "-files", "README.md", "testdata/pipeline.yml"}
+		main()
+		os.Exit(0)
+	}
+	after, err := ioutil.ReadFile("testdata/pipeline.yml.golden")
+	require.NoError(t, err)
+
+	// the runner settings are not required, even with the runner enabled
+	env := []string{"TEST_CONVERT_MAIN=1", "DRONE_USE_RUNNER=true"}
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, "DRONE_") {
+			env = append(env, variable)
+		}
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestConvertMain$")
+	cmd.Env = env
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	require.NoError(t, err, stderr.String())
+	require.Equal(t, string(after), string(out))
+}
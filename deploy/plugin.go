@@ -1,123 +1,201 @@
 package deploy
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 
+	"github.com/andrewstucki/drone-infrastructure-plugin/chain"
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/converter"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
+const name = "deploy"
+
 // New returns a new conversion plugin.
-func New() converter.Plugin {
+func New() chain.Converter {
 	return &plugin{}
 }
 
 type plugin struct{}
 
-type pipeline struct {
-	Name    string                   `yaml:"name"`
-	Kind    string                   `yaml:"kind,omitempty"`
-	Steps   []map[string]interface{} `yaml:"steps,omitempty"`
-	Volumes []map[string]interface{} `yaml:"volumes,omitempty"`
-	Deploy  *struct {
-		Repo      string `yaml:"repo"`
-		Registry  string `yaml:"registry"`
-		Terraform string `yaml:"terraform"`
-		Region    string `yaml:"region"`
-	} `yaml:"deploy,omitempty"`
-	Attrs map[string]interface{} `yaml:",inline"`
+type deploy struct {
+	Repo      string `yaml:"repo"`
+	Registry  string `yaml:"registry"`
+	Terraform string `yaml:"terraform"`
+	Region    string `yaml:"region"`
 }
 
-func (p *pipeline) update() error {
-	if p.Deploy != nil {
-		terraform := p.Deploy.Terraform
-		if terraform == "" {
-			terraform = "gracepoint/terraform:0.0.4"
-		}
-		region := p.Deploy.Region
-		if region == "" {
-			region = "us-east-1"
-		}
-		repo := p.Deploy.Repo
-		image := fmt.Sprintf("%s/%s:$DRONE_COMMIT", p.Deploy.Registry, p.Deploy.Repo)
+type environment struct {
+	AccessKeyID     document.FromSecret `yaml:"AWS_ACCESS_KEY_ID"`
+	SecretAccessKey document.FromSecret `yaml:"AWS_SECRET_ACCESS_KEY"`
+	DefaultRegion   string              `yaml:"AWS_DEFAULT_REGION,omitempty"`
+}
+
+type settings struct {
+	AutoTag   bool                `yaml:"auto_tag"`
+	Repo      string              `yaml:"repo"`
+	AccessKey document.FromSecret `yaml:"access_key"`
+	SecretKey document.FromSecret `yaml:"secret_key"`
+}
+
+type mount struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+}
+
+type step struct {
+	Name        string       `yaml:"name"`
+	Image       string       `yaml:"image"`
+	Volumes     []mount      `yaml:"volumes,omitempty"`
+	Settings    *settings    `yaml:"settings,omitempty"`
+	Commands    []string     `yaml:"commands,omitempty"`
+	Environment *environment `yaml:"environment,omitempty"`
+}
+
+type volume struct {
+	Name string `yaml:"name"`
+	Host struct {
+		Path string `yaml:"path"`
+	} `yaml:"host"`
+}
+
+// secrets are the secret documents that the deployment steps can reference
+var secrets = []*document.Secret{
+	document.NewSecret("deploy_access_key", "drone", "deploy-access-key"),
+	document.NewSecret("deploy_secret_key", "drone", "deploy-secret-key"),
+}
+
+func newEnvironment(region string, used document.Secrets) *environment {
+	return &environment{
+		AccessKeyID:     used.Ref("deploy_access_key"),
+		SecretAccessKey: used.Ref("deploy_secret_key"),
+		DefaultRegion:   region,
+	}
+}
+
+// update replaces the deploy block of a pipeline with the terraform
+// and publishing steps, it returns whether the pipeline was changed
+func update(doc *document.Document, used document.Secrets) (bool, error) {
+	root := doc.Root()
+	block := document.Lookup(root, "deploy")
+	if block == nil {
+		return false, nil
+	}
+	d := deploy{}
+	if err := block.Decode(&d); err != nil {
+		return false, err
+	}
+	if d.Repo == "" {
+		return false, errors.New("deploy block is missing a repo")
+	}
+	if d.Registry == "" {
+		return false, errors.New("deploy block is missing a registry")
+	}
+
+	terraform := d.Terraform
+	if terraform == "" {
+		terraform = "gracepoint/terraform:0.0.4"
+	}
+	region := d.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	image := fmt.Sprintf("%s/%s:$DRONE_COMMIT", d.Registry, d.Repo)
+
+	steps := []*step{
 		// initialization
-		p.Steps = append(p.Steps, map[string]interface{}{
-			"name":  "initialize terraform and ecr",
-			"image": terraform,
-			"commands": []string{
+		{
+			Name:  "initialize terraform and ecr",
+			Image: terraform,
+			Commands: []string{
 				"cp /root/.netrc . || true",
 				"decrypt < terraform.tfvars.encrypted > terraform.tfvars",
 				"terraform init",
 				fmt.Sprintf("terraform apply -auto-approve -target aws_ecr_repository.repo -var image=%s", image),
 			},
-			"environment": map[string]interface{}{
-				"AWS_ACCESS_KEY_ID": map[string]interface{}{
-					"from_secret": "deploy_access_key",
-				},
-				"AWS_SECRET_ACCESS_KEY": map[string]interface{}{
-					"from_secret": "deploy_secret_key",
-				},
-			},
-		})
+			Environment: newEnvironment("", used),
+		},
 		// image publishing
-		p.Steps = append(p.Steps, map[string]interface{}{
-			"name":  "publish",
-			"image": "andrewstucki/plugin-drone-ecr:1",
-			"volumes": []map[string]string{
-				{
-					"name": "docker",
-					"path": "/var/run/docker.sock",
-				},
-			},
-			"settings": map[string]interface{}{
-				"auto_tag": true,
-				"repo":     repo,
-				"access_key": map[string]interface{}{
-					"from_secret": "deploy_access_key",
-				},
-				"secret_key": map[string]interface{}{
-					"from_secret": "deploy_secret_key",
-				},
+		{
+			Name:  "publish",
+			Image: "andrewstucki/plugin-drone-ecr:1",
+			Volumes: []mount{{
+				Name: "docker",
+				Path: "/var/run/docker.sock",
+			}},
+			Settings: &settings{
+				AutoTag:   true,
+				Repo:      d.Repo,
+				AccessKey: used.Ref("deploy_access_key"),
+				SecretKey: used.Ref("deploy_secret_key"),
 			},
-		})
+		},
 		// apply
-		p.Steps = append(p.Steps, map[string]interface{}{
-			"name":  "deploy",
-			"image": terraform,
-			"commands": []string{
+		{
+			Name:  "deploy",
+			Image: terraform,
+			Commands: []string{
 				fmt.Sprintf("terraform apply -auto-approve -var image=%s", image),
-				fmt.Sprintf("wait-for-ecs `terraform output cluster` %s", p.Deploy.Repo),
-			},
-			"environment": map[string]interface{}{
-				"AWS_ACCESS_KEY_ID": map[string]interface{}{
-					"from_secret": "deploy_access_key",
-				},
-				"AWS_SECRET_ACCESS_KEY": map[string]interface{}{
-					"from_secret": "deploy_secret_key",
-				},
-				"AWS_DEFAULT_REGION": region,
+				fmt.Sprintf("wait-for-ecs `terraform output cluster` %s", d.Repo),
 			},
-		})
+			Environment: newEnvironment(region, used),
+		},
+	}
 
-		// add docker volume
-		p.Volumes = append(p.Volumes, map[string]interface{}{
-			"name": "docker",
-			"host": map[string]string{
-				"path": "/var/run/docker.sock",
-			},
-		})
+	stepsNode := document.Ensure(root, "steps", yaml.SequenceNode)
+	// replace the steps generated by an earlier conversion
+	document.RemoveMarked(stepsNode, name)
+	for _, s := range steps {
+		node, err := document.Encode(s)
+		if err != nil {
+			return false, err
+		}
+		document.Mark(node, name)
+		stepsNode.Content = append(stepsNode.Content, node)
+	}
 
-		p.Deploy = nil
+	// add docker volume
+	docker := volume{Name: "docker"}
+	docker.Host.Path = "/var/run/docker.sock"
+	node, err := document.Encode(&docker)
+	if err != nil {
+		return false, err
 	}
-	return nil
+	document.Mark(node, name)
+	volumes := document.Ensure(root, "volumes", yaml.SequenceNode)
+	document.RemoveMarked(volumes, name)
+	volumes.Content = append(volumes.Content, node)
+
+	document.Delete(root, "deploy")
+	doc.Touch()
+
+	return true, nil
 }
 
+// deployLine returns the line of the deploy key in a pipeline
+func deployLine(doc *document.Document) int {
+	if key := document.LookupKey(doc.Root(), "deploy"); key != nil {
+		return key.Line
+	}
+	return doc.Line()
+}
+
+// Name returns the name of the converter
+func (p *plugin) Name() string {
+	return name
+}
+
+// Convert adds deployment steps to the configuration
 func (p *plugin) Convert(ctx context.Context, req *converter.Request) (*drone.Config, error) {
+	return chain.Apply(ctx, req, p)
+}
+
+// ConvertConfig adds deployment steps to the parsed configuration
+func (p *plugin) ConvertConfig(ctx context.Context, req *converter.Request, config *document.Config) error {
 	logrus.WithFields(logrus.Fields{
 		"build_action":   req.Build.Action,
 		"build_after":    req.Build.After,
@@ -132,72 +210,30 @@ func (p *plugin) Convert(ctx context.Context, req *converter.Request) (*drone.Co
 		"build_trigger":  req.Build.Trigger,
 		"repo_namespace": req.Repo.Namespace,
 		"repo_name":      req.Repo.Name,
-	}).Debugln("initiated path skipping convert plugin")
-
-	pipelines := []*pipeline{}
-
-	decoder := yaml.NewDecoder(bytes.NewBuffer([]byte(req.Config.Data)))
-	for {
-		pipeline := new(pipeline)
-		err := decoder.Decode(pipeline)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"build_id":       req.Build.ID,
-				"repo_namespace": req.Repo.Namespace,
-				"repo_name":      req.Repo.Name,
-			}).Errorln(err)
-			return nil, nil
-		}
-		pipelines = append(pipelines, pipeline)
-	}
+	}).Debugln("initiated deploy convert plugin")
 
-	for _, p := range pipelines {
-		if err := p.update(); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"build_id":       req.Build.ID,
-				"repo_namespace": req.Repo.Namespace,
-				"repo_name":      req.Repo.Name,
-			}).Errorln(err)
-			return nil, nil
+	used := document.Secrets{}
+	for _, doc := range config.Pipelines() {
+		line := deployLine(doc)
+		if _, err := update(doc, used); err != nil {
+			return &chain.Error{
+				Kind:      chain.ErrInvalid,
+				Converter: name,
+				File:      req.Repo.Config,
+				Line:      line,
+				Pipeline:  doc.Name(),
+				Err:       err,
+			}
 		}
 	}
 
-	pipelines = append(pipelines, &pipeline{
-		Name: "deploy_access_key",
-		Kind: "secret",
-		Attrs: map[string]interface{}{
-			"get": map[string]interface{}{
-				"path": "drone",
-				"name": "deploy-access-key",
-			},
-		},
-	}, &pipeline{
-		Name: "deploy_secret_key",
-		Kind: "secret",
-		Attrs: map[string]interface{}{
-			"get": map[string]interface{}{
-				"path": "drone",
-				"name": "deploy-secret-key",
-			},
-		},
-	})
-
-	buffer := new(bytes.Buffer)
-	encoder := yaml.NewEncoder(buffer)
-	for _, p := range pipelines {
-		if err := encoder.Encode(p); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"build_id":       req.Build.ID,
-				"repo_namespace": req.Repo.Namespace,
-				"repo_name":      req.Repo.Name,
-			}).Errorln(err)
-			return nil, nil
+	if err := config.AppendSecrets(name, used, secrets...); err != nil {
+		return &chain.Error{
+			Kind:      chain.ErrEncode,
+			Converter: name,
+			File:      req.Repo.Config,
+			Err:       err,
 		}
 	}
-	return &drone.Config{
-		Data: buffer.String(),
-	}, nil
+	return nil
 }
@@ -2,10 +2,12 @@ package deploy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"testing"
 
+	"github.com/andrewstucki/drone-infrastructure-plugin/chain"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/converter"
 	"github.com/stretchr/testify/require"
@@ -18,6 +20,9 @@ func TestPlugin(t *testing.T) {
 		file string
 	}{
 		{"pipeline"},
+		{"anchors"},
+		{"secrets"},
+		{"vanilla"},
 	}
 	for _, test := range tests {
 		t.Run(test.file, func(t *testing.T) {
@@ -47,6 +52,36 @@ func TestPlugin(t *testing.T) {
 			require.NoError(t, err)
 			require.NotNil(t, config)
 			require.Equal(t, string(after), config.Data)
+
+			// converting the output again must leave it unchanged
+			req.Config.Data = config.Data
+			config, err = New().Convert(noContext, req)
+			require.NoError(t, err)
+			require.NotNil(t, config)
+			require.Equal(t, string(after), config.Data)
 		})
 	}
 }
+
+func TestPluginInvalid(t *testing.T) {
+	before, err := ioutil.ReadFile("testdata/invalid.yml")
+	require.NoError(t, err)
+
+	req := &converter.Request{
+		Repo: drone.Repo{
+			Slug:   "octocat/hello-world",
+			Config: ".drone.yml",
+		},
+		Config: drone.Config{
+			Data: string(before),
+		},
+	}
+
+	config, err := New().Convert(noContext, req)
+	require.Nil(t, config)
+	require.EqualError(t, err, `deploy: .drone.yml:4: pipeline "deploy": invalid configuration: deploy block is missing a registry`)
+
+	var converterErr *chain.Error
+	require.True(t, errors.As(err, &converterErr))
+	require.Equal(t, chain.ErrInvalid, converterErr.Kind)
+}
@@ -0,0 +1,303 @@
+// Package document provides a yaml model of a multi-document drone
+// configuration that can be shared and mutated by a series of converters
+// while preserving the formatting of every document they leave alone.
+package document
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ParseError is returned when the configuration is not valid yaml
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying yaml error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Document is a single yaml document in a configuration
+type Document struct {
+	// Node is the parsed document node, it is nil for
+	// documents that only contain comments or whitespace
+	Node *yaml.Node
+
+	separator string // the document separator line, if any
+	raw       string // the original text of the document, including its separator
+	trailer   string // the blank lines following the document content
+	dirty     bool
+}
+
+// Root returns the top-level mapping of the document, or nil if
+// the document is empty or not a mapping
+func (d *Document) Root() *yaml.Node {
+	if d.Node == nil || len(d.Node.Content) == 0 {
+		return nil
+	}
+	root := d.Node.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	return root
+}
+
+// Kind returns the kind of the document
+func (d *Document) Kind() string {
+	return ScalarValue(d.Root(), "kind")
+}
+
+// Name returns the name of the document
+func (d *Document) Name() string {
+	return ScalarValue(d.Root(), "name")
+}
+
+// Line returns the line at which the document content starts
+func (d *Document) Line() int {
+	if root := d.Root(); root != nil {
+		return root.Line
+	}
+	return 0
+}
+
+// Touch marks the document as modified so that it is re-encoded
+// when the configuration is serialized
+func (d *Document) Touch() {
+	d.dirty = true
+}
+
+// Modified returns whether the document has been touched
+func (d *Document) Modified() bool {
+	return d.dirty
+}
+
+// Config is a parsed multi-document configuration
+type Config struct {
+	Documents []*Document
+
+	removed bool
+}
+
+var separatorExpr = regexp.MustCompile(`^---(\s|$)`)
+
+// split breaks the configuration text into its raw documents
+func split(data string) []string {
+	chunks := []string{}
+	var current strings.Builder
+	for _, line := range strings.SplitAfter(data, "\n") {
+		if separatorExpr.MatchString(line) && current.Len() > 0 {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+		current.WriteString(line)
+	}
+	if current.Len() > 0 {
+		chunks = append(chunks, current.String())
+	}
+	return chunks
+}
+
+var lineExpr = regexp.MustCompile(`line (\d+)`)
+
+// offsetLines shifts the line numbers of a node tree decoded from a
+// single document so that they are relative to the whole configuration
+func offsetLines(node *yaml.Node, offset int) {
+	if node.Line > 0 {
+		node.Line += offset
+	}
+	for _, child := range node.Content {
+		offsetLines(child, offset)
+	}
+}
+
+// trailingBlankLines returns the blank lines separating the document
+// content from the next document
+func trailingBlankLines(s string) string {
+	trimmed := strings.TrimRight(s, " \t\r\n")
+	count := strings.Count(s[len(trimmed):], "\n")
+	if count <= 1 {
+		return ""
+	}
+	return strings.Repeat("\n", count-1)
+}
+
+// Parse parses the configuration into a series of documents
+func Parse(data string) (*Config, error) {
+	config := &Config{}
+	offset := 0
+	for _, chunk := range split(data) {
+		doc := &Document{raw: chunk}
+		if separatorExpr.MatchString(chunk) {
+			end := strings.Index(chunk, "\n") + 1
+			if end == 0 {
+				end = len(chunk)
+			}
+			doc.separator = chunk[:end]
+		}
+		doc.trailer = trailingBlankLines(chunk)
+
+		node := new(yaml.Node)
+		err := yaml.NewDecoder(strings.NewReader(chunk)).Decode(node)
+		switch {
+		case err == io.EOF:
+		case err != nil:
+			line := 0
+			if match := lineExpr.FindStringSubmatch(err.Error()); match != nil {
+				line, _ = strconv.Atoi(match[1])
+				line += offset
+				err = fmt.Errorf("%s", lineExpr.ReplaceAllString(err.Error(), "line "+strconv.Itoa(line)))
+			}
+			return nil, &ParseError{Line: line, Err: err}
+		default:
+			offsetLines(node, offset)
+			doc.Node = node
+		}
+
+		config.Documents = append(config.Documents, doc)
+		offset += strings.Count(chunk, "\n")
+	}
+	return config, nil
+}
+
+// Pipelines returns all of the documents of kind pipeline
+func (c *Config) Pipelines() []*Document {
+	pipelines := []*Document{}
+	for _, doc := range c.Documents {
+		if doc.Kind() == "pipeline" {
+			pipelines = append(pipelines, doc)
+		}
+	}
+	return pipelines
+}
+
+// Append encodes the value and appends it as a new document
+func (c *Config) Append(v interface{}) error {
+	node := new(yaml.Node)
+	if err := node.Encode(v); err != nil {
+		return err
+	}
+	c.Documents = append(c.Documents, &Document{
+		Node: &yaml.Node{
+			Kind:    yaml.DocumentNode,
+			Content: []*yaml.Node{node},
+		},
+		separator: "---\n",
+		dirty:     true,
+	})
+	return nil
+}
+
+// Remove removes the document from the configuration
+func (c *Config) Remove(doc *Document) {
+	for i, d := range c.Documents {
+		if d == doc {
+			c.Documents = append(c.Documents[:i], c.Documents[i+1:]...)
+			c.removed = true
+			return
+		}
+	}
+}
+
+// Modified returns whether any of the documents have been touched
+// or removed
+func (c *Config) Modified() bool {
+	if c.removed {
+		return true
+	}
+	for _, doc := range c.Documents {
+		if doc.dirty {
+			return true
+		}
+	}
+	return false
+}
+
+// String serializes the configuration, documents that were not
+// touched are returned exactly as they were parsed
+func (c *Config) String() (string, error) {
+	var out strings.Builder
+	for i, doc := range c.Documents {
+		if !doc.dirty {
+			out.WriteString(doc.raw)
+			continue
+		}
+		separator := doc.separator
+		if separator == "" && i > 0 {
+			separator = "---\n"
+		}
+		if out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+			out.WriteString("\n")
+		}
+		out.WriteString(separator)
+
+		clearMergeTags(doc.Node)
+		buffer := new(bytes.Buffer)
+		encoder := yaml.NewEncoder(buffer)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(doc.Node); err != nil {
+			return "", err
+		}
+		if err := encoder.Close(); err != nil {
+			return "", err
+		}
+		out.WriteString(buffer.String())
+		out.WriteString(doc.trailer)
+	}
+	return out.String(), nil
+}
+
+// clearMergeTags drops the explicit tag on merge keys, which
+// the encoder would otherwise emit as "!!merge <<"
+func clearMergeTags(node *yaml.Node) {
+	if node == nil {
+		return
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!merge" {
+		node.Tag = ""
+	}
+	for _, child := range node.Content {
+		clearMergeTags(child)
+	}
+}
+
+// Clone returns a deep copy of the configuration
+func (c *Config) Clone() *Config {
+	clone := &Config{removed: c.removed}
+	for _, doc := range c.Documents {
+		copied := *doc
+		copied.Node = copyNode(doc.Node, map[*yaml.Node]*yaml.Node{})
+		clone.Documents = append(clone.Documents, &copied)
+	}
+	return clone
+}
+
+// copyNode deep copies a node tree, pointing aliases at the copies
+// of their anchors
+func copyNode(node *yaml.Node, copies map[*yaml.Node]*yaml.Node) *yaml.Node {
+	if node == nil {
+		return nil
+	}
+	if copied, ok := copies[node]; ok {
+		return copied
+	}
+	copied := *node
+	copies[node] = &copied
+	copied.Content = nil
+	for _, child := range node.Content {
+		copied.Content = append(copied.Content, copyNode(child, copies))
+	}
+	copied.Alias = copyNode(node.Alias, copies)
+	return &copied
+}
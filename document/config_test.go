@@ -0,0 +1,132 @@
+package document
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const multiple = `# leading comment
+---
+kind: pipeline
+name: first # trailing comment
+
+steps:
+  - name: build
+    image: golang
+
+
+---
+kind: pipeline
+name:   second
+---
+kind: secret
+name: token
+`
+
+func TestParseUnmodified(t *testing.T) {
+	config, err := Parse(multiple)
+	require.NoError(t, err)
+	require.Len(t, config.Documents, 4)
+	require.Nil(t, config.Documents[0].Node)
+	require.Len(t, config.Pipelines(), 2)
+	require.Equal(t, "first", config.Documents[1].Name())
+	require.Equal(t, "second", config.Documents[2].Name())
+	require.Equal(t, "secret", config.Documents[3].Kind())
+
+	require.False(t, config.Modified())
+	data, err := config.String()
+	require.NoError(t, err)
+	require.Equal(t, multiple, data)
+}
+
+func TestParseLines(t *testing.T) {
+	config, err := Parse(multiple)
+	require.NoError(t, err)
+	require.Equal(t, 3, config.Documents[1].Line())
+	require.Equal(t, 12, config.Documents[2].Line())
+	require.Equal(t, 6, LookupKey(config.Documents[1].Root(), "steps").Line)
+
+	// syntax errors report the same line as decoding the whole stream
+	broken := "kind: pipeline\n---\nkind: pipeline\nname: [broken\n"
+	decoder := yaml.NewDecoder(strings.NewReader(broken))
+	require.NoError(t, decoder.Decode(new(yaml.Node)))
+	expected := decoder.Decode(new(yaml.Node))
+	require.Error(t, expected)
+
+	_, err = Parse(broken)
+	var parseErr *ParseError
+	require.True(t, errors.As(err, &parseErr))
+	require.Equal(t, 3, parseErr.Line)
+	require.EqualError(t, err, expected.Error())
+}
+
+func TestStringModified(t *testing.T) {
+	config, err := Parse(multiple)
+	require.NoError(t, err)
+
+	doc := config.Documents[2]
+	Set(doc.Root(), "type", Scalar("docker"))
+	doc.Touch()
+	require.NoError(t, config.Append(map[string]string{"kind": "signature"}))
+
+	data, err := config.String()
+	require.NoError(t, err)
+	require.Equal(t, `# leading comment
+---
+kind: pipeline
+name: first # trailing comment
+
+steps:
+  - name: build
+    image: golang
+
+
+---
+kind: pipeline
+name: second
+type: docker
+---
+kind: secret
+name: token
+---
+kind: signature
+`, data)
+}
+
+func TestRemove(t *testing.T) {
+	config, err := Parse(multiple)
+	require.NoError(t, err)
+
+	config.Remove(config.Documents[1])
+	require.True(t, config.Modified())
+	data, err := config.String()
+	require.NoError(t, err)
+	require.Equal(t, `# leading comment
+---
+kind: pipeline
+name:   second
+---
+kind: secret
+name: token
+`, data)
+}
+
+func TestClone(t *testing.T) {
+	config, err := Parse("kind: pipeline\nx: &x\n  a: b\ny: *x\n")
+	require.NoError(t, err)
+
+	clone := config.Clone()
+	root := clone.Documents[0].Root()
+	Set(root, "kind", Scalar("secret"))
+	require.Equal(t, "pipeline", config.Documents[0].Kind())
+	require.Equal(t, "secret", clone.Documents[0].Kind())
+
+	// aliases point at the cloned anchors
+	alias := root.Content[5]
+	require.Equal(t, yaml.AliasNode, alias.Kind)
+	require.True(t, alias.Alias == root.Content[3])
+}
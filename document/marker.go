@@ -0,0 +1,96 @@
+package document
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+// MarkerKey is the reserved key used to annotate the nodes that a
+// converter generated or modified, so that converting a configuration
+// that was already converted does not apply the changes a second time.
+//
+// Generated nodes are marked with the name of the converter:
+//
+//	x-infrastructure: cache
+//
+// Modified mappings keep the values that the converter replaced:
+//
+//	x-infrastructure:
+//	  paths:
+//	    event: [push]
+const MarkerKey = "x-infrastructure"
+
+// Mark annotates a generated mapping with the converter name
+func Mark(mapping *yaml.Node, converter string) {
+	Set(mapping, MarkerKey, Scalar(converter))
+}
+
+// Marked returns whether the mapping was generated by the converter
+func Marked(mapping *yaml.Node, converter string) bool {
+	return ScalarValue(mapping, MarkerKey) == converter
+}
+
+// RemoveMarked removes the items of a sequence that were generated by
+// the converter and returns whether any were removed
+func RemoveMarked(sequence *yaml.Node, converter string) bool {
+	content := []*yaml.Node{}
+	for _, item := range sequence.Content {
+		if !Marked(item, converter) {
+			content = append(content, item)
+		}
+	}
+	removed := len(content) != len(sequence.Content)
+	sequence.Content = content
+	return removed
+}
+
+// nullNode records that a key was not set before it was stashed
+func nullNode() *yaml.Node {
+	return &yaml.Node{
+		Kind:  yaml.ScalarNode,
+		Tag:   "!!null",
+		Value: "null",
+	}
+}
+
+// Stash saves the current value of key in the mapping under the
+// converter's marker before the converter replaces it. Values that
+// were already stashed are kept, so the original is never lost.
+func Stash(mapping *yaml.Node, converter, key string) {
+	marker := Ensure(mapping, MarkerKey, yaml.MappingNode)
+	stash := Ensure(marker, converter, yaml.MappingNode)
+	if index(stash, key) >= 0 {
+		return
+	}
+	value := nullNode()
+	if i := index(mapping, key); i >= 0 {
+		value = Copy(mapping.Content[i])
+	}
+	Set(stash, key, value)
+}
+
+// Restore puts back the values that the converter stashed in the
+// mapping, it returns whether the mapping was changed
+func Restore(mapping *yaml.Node, converter string) bool {
+	i := index(mapping, MarkerKey)
+	if i < 0 || mapping.Content[i].Kind != yaml.MappingNode {
+		return false
+	}
+	marker := mapping.Content[i]
+	if i = index(marker, converter); i < 0 {
+		return false
+	}
+	stash := resolve(marker.Content[i])
+	for j := 0; j+1 < len(stash.Content); j += 2 {
+		key, value := stash.Content[j].Value, stash.Content[j+1]
+		if value.Tag == "!!null" {
+			Delete(mapping, key)
+		} else {
+			Set(mapping, key, value)
+		}
+	}
+	Delete(marker, converter)
+	if len(marker.Content) == 0 {
+		Delete(mapping, MarkerKey)
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package document
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRemoveMarked(t *testing.T) {
+	config, err := Parse(`steps:
+  - name: restore
+    x-infrastructure: cache
+  - name: build
+  - name: publish
+    x-infrastructure: deploy
+`)
+	require.NoError(t, err)
+	steps := Lookup(config.Documents[0].Root(), "steps")
+
+	require.True(t, Marked(steps.Content[0], "cache"))
+	require.False(t, Marked(steps.Content[1], "cache"))
+	require.True(t, RemoveMarked(steps, "cache"))
+	require.False(t, RemoveMarked(steps, "cache"))
+	require.Len(t, steps.Content, 2)
+	require.Equal(t, "build", ScalarValue(steps.Content[0], "name"))
+	require.Equal(t, "publish", ScalarValue(steps.Content[1], "name"))
+}
+
+func TestStashRestore(t *testing.T) {
+	config, err := Parse(`trigger:
+  branch: [master]
+  event: [push]
+`)
+	require.NoError(t, err)
+	trigger := Lookup(config.Documents[0].Root(), "trigger")
+
+	Stash(trigger, "paths", "event")
+	Set(trigger, "event", Scalar("skip"))
+	Stash(trigger, "paths", "branch")
+	Delete(trigger, "branch")
+	// stashing again keeps the original value
+	Stash(trigger, "paths", "event")
+
+	require.True(t, Restore(trigger, "paths"))
+	require.False(t, Restore(trigger, "paths"))
+	require.Nil(t, Lookup(trigger, MarkerKey))
+
+	values := map[string][]string{}
+	require.NoError(t, trigger.Decode(&values))
+	require.Equal(t, map[string][]string{
+		"branch": {"master"},
+		"event":  {"push"},
+	}, values)
+}
+
+func TestRestoreUnset(t *testing.T) {
+	when := &yaml.Node{Kind: yaml.MappingNode}
+	Stash(when, "paths", "event")
+	Set(when, "event", Scalar("skip"))
+
+	require.True(t, Restore(when, "paths"))
+	require.Empty(t, when.Content)
+}
@@ -0,0 +1,186 @@
+package document
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+const mergeKey = "<<"
+
+// resolve follows an alias to the node it refers to
+func resolve(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// index returns the position of the value for key in the mapping, or -1
+func index(mapping *yaml.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key && !isMerge(mapping.Content[i]) {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func isMerge(key *yaml.Node) bool {
+	return key.Kind == yaml.ScalarNode && key.Value == mergeKey && (key.Tag == "" || key.Tag == "!!merge")
+}
+
+// merged returns the mappings merged into the mapping with "<<" keys,
+// in order of precedence
+func merged(mapping *yaml.Node) []*yaml.Node {
+	mappings := []*yaml.Node{}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if !isMerge(mapping.Content[i]) {
+			continue
+		}
+		value := resolve(mapping.Content[i+1])
+		switch value.Kind {
+		case yaml.MappingNode:
+			mappings = append(mappings, value)
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				if item = resolve(item); item.Kind == yaml.MappingNode {
+					mappings = append(mappings, item)
+				}
+			}
+		}
+	}
+	return mappings
+}
+
+// lookup returns the key and value nodes for key, searching merged
+// mappings when the key is not set directly
+func lookup(mapping *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	mapping = resolve(mapping)
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	if i := index(mapping, key); i >= 0 {
+		return mapping.Content[i-1], resolve(mapping.Content[i])
+	}
+	for _, m := range merged(mapping) {
+		if k, v := lookup(m, key); v != nil {
+			return k, v
+		}
+	}
+	return nil, nil
+}
+
+// Lookup returns the value for key in the mapping, or nil if the
+// mapping does not have the key. Aliases are resolved and keys
+// inherited through "<<" merge keys are taken into account.
+func Lookup(mapping *yaml.Node, key string) *yaml.Node {
+	_, value := lookup(mapping, key)
+	return value
+}
+
+// LookupKey returns the key node for key in the mapping, which
+// carries the position of the key in the source document
+func LookupKey(mapping *yaml.Node, key string) *yaml.Node {
+	k, _ := lookup(mapping, key)
+	return k
+}
+
+// ScalarValue returns the scalar value for key in the mapping, or
+// an empty string if the key is not set to a scalar
+func ScalarValue(mapping *yaml.Node, key string) string {
+	value := Lookup(mapping, key)
+	if value == nil || value.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return value.Value
+}
+
+// Set sets the value for key directly in the mapping, replacing any
+// existing value and otherwise appending the key. Values inherited
+// through merge keys are overridden rather than modified.
+func Set(mapping *yaml.Node, key string, value *yaml.Node) {
+	if i := index(mapping, key); i >= 0 {
+		mapping.Content[i] = value
+		return
+	}
+	mapping.Content = append(mapping.Content, Scalar(key), value)
+}
+
+// Delete removes the key from the mapping
+func Delete(mapping *yaml.Node, key string) {
+	if i := index(mapping, key); i >= 0 {
+		mapping.Content = append(mapping.Content[:i-1], mapping.Content[i+1:]...)
+	}
+}
+
+// Ensure returns a value for key in the mapping that can be safely
+// modified, creating an empty node of the given kind if the key is
+// not set. Values that are aliases or that are inherited through a
+// merge key are copied into the mapping first so that changes do not
+// leak into the anchored node and the other places that refer to it.
+func Ensure(mapping *yaml.Node, key string, kind yaml.Kind) *yaml.Node {
+	if i := index(mapping, key); i >= 0 {
+		value := mapping.Content[i]
+		if value.Kind == yaml.AliasNode && resolve(value).Kind == kind {
+			value = Copy(resolve(value))
+			mapping.Content[i] = value
+		}
+		if value.Kind == kind {
+			return value
+		}
+	} else if value := Lookup(mapping, key); value != nil && value.Kind == kind {
+		value = Copy(value)
+		Set(mapping, key, value)
+		return value
+	}
+	value := &yaml.Node{Kind: kind}
+	Set(mapping, key, value)
+	return value
+}
+
+// Own returns the item at position i in a sequence, replacing it
+// with a copy of the anchored node if it is an alias so that it can
+// be safely modified
+func Own(sequence *yaml.Node, i int) *yaml.Node {
+	item := sequence.Content[i]
+	if item.Kind == yaml.AliasNode {
+		item = Copy(resolve(item))
+		sequence.Content[i] = item
+	}
+	return item
+}
+
+// Copy returns a deep copy of the node without its anchors, aliases
+// inside the node keep referring to the original anchors
+func Copy(node *yaml.Node) *yaml.Node {
+	if node == nil {
+		return nil
+	}
+	copied := *node
+	copied.Anchor = ""
+	if node.Kind == yaml.AliasNode {
+		return &copied
+	}
+	copied.Content = nil
+	for _, child := range node.Content {
+		copied.Content = append(copied.Content, Copy(child))
+	}
+	return &copied
+}
+
+// Scalar returns a string scalar node
+func Scalar(value string) *yaml.Node {
+	return &yaml.Node{
+		Kind:  yaml.ScalarNode,
+		Tag:   "!!str",
+		Value: value,
+	}
+}
+
+// Encode encodes the value as a yaml node
+func Encode(v interface{}) (*yaml.Node, error) {
+	node := new(yaml.Node)
+	if err := node.Encode(v); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
@@ -0,0 +1,104 @@
+package document
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const anchored = `kind: pipeline
+x-base: &base
+  image: alpine
+  when:
+    branch: [master]
+x-extra: &extra
+  image: golang
+  detach: true
+steps:
+  - &first
+    name: first
+    <<: [*base, *extra]
+  - *first
+  - name: last
+    <<: *base
+    image: node
+`
+
+func parseAnchored(t *testing.T) (*Config, *yaml.Node) {
+	config, err := Parse(anchored)
+	require.NoError(t, err)
+	return config, config.Documents[0].Root()
+}
+
+func TestLookupMerge(t *testing.T) {
+	_, root := parseAnchored(t)
+	steps := Lookup(root, "steps")
+	require.Len(t, steps.Content, 3)
+
+	first, alias, last := steps.Content[0], steps.Content[1], steps.Content[2]
+	// earlier merged mappings take precedence
+	require.Equal(t, "alpine", ScalarValue(first, "image"))
+	require.Equal(t, "true", ScalarValue(first, "detach"))
+	// aliases are resolved
+	require.Equal(t, "first", ScalarValue(alias, "name"))
+	// explicit keys override merged keys
+	require.Equal(t, "node", ScalarValue(last, "image"))
+	require.Equal(t, 4, LookupKey(last, "when").Line)
+	require.Nil(t, Lookup(last, "missing"))
+}
+
+func TestEnsureCopiesMerged(t *testing.T) {
+	config, root := parseAnchored(t)
+	steps := Ensure(root, "steps", yaml.SequenceNode)
+
+	last := Own(steps, 2)
+	when := Ensure(last, "when", yaml.MappingNode)
+	Set(when, "event", Scalar("push"))
+
+	// the anchored defaults are left alone
+	require.Equal(t, "", ScalarValue(Lookup(root, "x-base"), "event"))
+	require.Equal(t, "", ScalarValue(Lookup(steps.Content[0], "when"), "event"))
+	require.Equal(t, "push", ScalarValue(Lookup(last, "when"), "event"))
+
+	// and the alias is replaced by a copy when owned
+	second := Own(steps, 1)
+	Set(second, "name", Scalar("second"))
+	require.Equal(t, "first", ScalarValue(steps.Content[0], "name"))
+	require.Equal(t, "second", ScalarValue(steps.Content[1], "name"))
+
+	config.Documents[0].Touch()
+	data, err := config.String()
+	require.NoError(t, err)
+	require.Equal(t, `kind: pipeline
+x-base: &base
+  image: alpine
+  when:
+    branch: [master]
+x-extra: &extra
+  image: golang
+  detach: true
+steps:
+  - &first
+    name: first
+    <<: [*base, *extra]
+  - name: second
+    <<: [*base, *extra]
+  - name: last
+    <<: *base
+    image: node
+    when:
+      branch: [master]
+      event: push
+`, data)
+}
+
+func TestEnsureCreates(t *testing.T) {
+	_, root := parseAnchored(t)
+	volumes := Ensure(root, "volumes", yaml.SequenceNode)
+	require.Equal(t, yaml.SequenceNode, volumes.Kind)
+	require.True(t, volumes == Lookup(root, "volumes"))
+
+	Delete(root, "volumes")
+	require.Nil(t, Lookup(root, "volumes"))
+}
@@ -0,0 +1,63 @@
+package document
+
+// FromSecret references a secret from a step setting or environment variable
+type FromSecret struct {
+	FromSecret string `yaml:"from_secret"`
+}
+
+// Secrets records the secrets that a converter referenced
+type Secrets map[string]bool
+
+// Ref records the use of the named secret and returns a reference to it
+func (s Secrets) Ref(name string) FromSecret {
+	s[name] = true
+	return FromSecret{FromSecret: name}
+}
+
+// Secret is a secret document that retrieves its value from
+// the secrets plugin
+type Secret struct {
+	Kind string `yaml:"kind"`
+	Name string `yaml:"name"`
+	Get  struct {
+		Path string `yaml:"path"`
+		Name string `yaml:"name"`
+	} `yaml:"get"`
+}
+
+// NewSecret returns a secret document for the key stored at path
+func NewSecret(name, path, key string) *Secret {
+	s := &Secret{
+		Kind: "secret",
+		Name: name,
+	}
+	s.Get.Path = path
+	s.Get.Name = key
+	return s
+}
+
+// Secret returns the secret document with the given name, or nil
+func (c *Config) Secret(name string) *Document {
+	for _, doc := range c.Documents {
+		if doc.Kind() == "secret" && doc.Name() == name {
+			return doc
+		}
+	}
+	return nil
+}
+
+// AppendSecrets appends the secret documents that were referenced
+// and that are not already defined in the configuration, marking
+// them as generated by the converter
+func (c *Config) AppendSecrets(converter string, used Secrets, secrets ...*Secret) error {
+	for _, s := range secrets {
+		if !used[s.Name] || c.Secret(s.Name) != nil {
+			continue
+		}
+		if err := c.Append(s); err != nil {
+			return err
+		}
+		Mark(c.Documents[len(c.Documents)-1].Root(), converter)
+	}
+	return nil
+}
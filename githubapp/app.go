@@ -0,0 +1,288 @@
+package githubapp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the lifetime of the tokens authenticating as the app, GitHub allows
+// at most ten minutes, and how long before their expiry installation
+// tokens are refreshed
+const (
+	jwtLifetime   = 9 * time.Minute
+	jwtClockSkew  = time.Minute
+	refreshMargin = 5 * time.Minute
+)
+
+// errNotInstalled is returned for an owner the app is not installed on
+var errNotInstalled = errors.New("app is not installed")
+
+// LoadPrivateKey reads the PEM encoded private key of an app, in the
+// PKCS #1 format GitHub generates or in PKCS #8
+func LoadPrivateKey(file string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded key", file)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", file)
+	}
+	return key, nil
+}
+
+// App authenticates requests to the GitHub API as the installations of
+// a GitHub App, minting an installation token for each owner of the
+// repositories it is installed on and refreshing it before it expires
+type App struct {
+	id       int64
+	key      *rsa.PrivateKey
+	endpoint *url.URL
+	base     http.RoundTripper
+	now      func() time.Time
+
+	mu            sync.Mutex
+	locks         map[string]*sync.Mutex
+	installations map[string]int64
+	tokens        map[string]token
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+// New returns the app with the id and private key, for the GitHub API
+// at the endpoint, like https://api.github.com/ or the /api/v3/ of a
+// GitHub Enterprise server
+func New(endpoint string, id int64, key *rsa.PrivateKey) (*App, error) {
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &App{
+		id:            id,
+		key:           key,
+		endpoint:      base,
+		base:          http.DefaultTransport,
+		now:           time.Now,
+		locks:         map[string]*sync.Mutex{},
+		installations: map[string]int64{},
+		tokens:        map[string]token{},
+	}, nil
+}
+
+// Token returns an installation token for the repositories of the
+// owner, minting one if the last one expires soon
+func (a *App) Token(ctx context.Context, owner string) (string, error) {
+	owner = strings.ToLower(owner)
+	lock := a.lock(owner)
+	lock.Lock()
+	defer lock.Unlock()
+
+	a.mu.Lock()
+	current, ok := a.tokens[owner]
+	a.mu.Unlock()
+	if ok && a.now().Add(refreshMargin).Before(current.expires) {
+		return current.value, nil
+	}
+
+	id, err := a.installation(ctx, owner)
+	if err != nil {
+		return "", fmt.Errorf("github app installation for %s: %w", owner, err)
+	}
+	minted, err := a.mint(ctx, id)
+	if err != nil {
+		// the app may have been installed again since
+		a.mu.Lock()
+		delete(a.installations, owner)
+		a.mu.Unlock()
+		return "", fmt.Errorf("github app token for %s: %w", owner, err)
+	}
+	a.mu.Lock()
+	a.tokens[owner] = minted
+	a.mu.Unlock()
+	return minted.value, nil
+}
+
+func (a *App) lock(owner string) *sync.Mutex {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lock, ok := a.locks[owner]
+	if !ok {
+		lock = &sync.Mutex{}
+		a.locks[owner] = lock
+	}
+	return lock
+}
+
+// installation returns the id of the installation of the app on the
+// organization or user
+func (a *App) installation(ctx context.Context, owner string) (int64, error) {
+	a.mu.Lock()
+	id, ok := a.installations[owner]
+	a.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	err := a.do(ctx, http.MethodGet, "orgs/"+url.PathEscape(owner)+"/installation", &installation)
+	if errors.Is(err, errNotInstalled) {
+		err = a.do(ctx, http.MethodGet, "users/"+url.PathEscape(owner)+"/installation", &installation)
+	}
+	if err != nil {
+		return 0, err
+	}
+	a.mu.Lock()
+	a.installations[owner] = installation.ID
+	a.mu.Unlock()
+	return installation.ID, nil
+}
+
+// mint creates a token for the installation
+func (a *App) mint(ctx context.Context, installation int64) (token, error) {
+	var minted struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	path := "app/installations/" + strconv.FormatInt(installation, 10) + "/access_tokens"
+	if err := a.do(ctx, http.MethodPost, path, &minted); err != nil {
+		return token{}, err
+	}
+	return token{value: minted.Token, expires: minted.ExpiresAt}, nil
+}
+
+// do sends a request authenticated as the app and decodes the response
+func (a *App) do(ctx context.Context, method, path string, v interface{}) error {
+	jwt, err := a.jwt()
+	if err != nil {
+		return err
+	}
+	target := a.endpoint.ResolveReference(&url.URL{Path: path})
+	req, err := http.NewRequest(method, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	res, err := a.base.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, res.Body)
+		return errNotInstalled
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		io.Copy(ioutil.Discard, res.Body)
+		return fmt.Errorf("%s %s: %s", method, target, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// jwt returns a token authenticating as the app, signed with RS256
+func (a *App) jwt() (string, error) {
+	now := a.now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]int64{
+		// backdated in case the clock of GitHub is behind
+		"iat": now.Add(-jwtClockSkew).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": a.id,
+	})
+	if err != nil {
+		return "", err
+	}
+	var unsigned bytes.Buffer
+	unsigned.WriteString(base64.RawURLEncoding.EncodeToString(header))
+	unsigned.WriteByte('.')
+	unsigned.WriteString(base64.RawURLEncoding.EncodeToString(claims))
+	digest := sha256.Sum256(unsigned.Bytes())
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned.String() + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Client returns an http client that authenticates every request with
+// the installation token of the owner named by its path, like the
+// owner of /repos/{owner}/{repo} or the organization of /orgs/{org},
+// and with the token of the default owner for the other requests
+func (a *App) Client(owner string) *http.Client {
+	return &http.Client{
+		Transport: &transport{app: a, owner: owner},
+	}
+}
+
+type transport struct {
+	app   *App
+	owner string
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	value, err := t.app.Token(req.Context(), t.app.owner(req.URL, t.owner))
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	// a round tripper must not modify the request
+	authenticated := req.Clone(req.Context())
+	authenticated.Header.Set("Authorization", "token "+value)
+	return t.app.base.RoundTrip(authenticated)
+}
+
+// owner returns the owner named by the path of the API request, or the
+// default owner
+func (a *App) owner(target *url.URL, owner string) string {
+	path := strings.TrimPrefix(target.Path, a.endpoint.Path)
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) >= 2 {
+		switch segments[0] {
+		case "repos", "orgs":
+			return segments[1]
+		}
+	}
+	return owner
+}
@@ -0,0 +1,176 @@
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var noContext = context.Background()
+
+// appKey is shared by the tests since generating keys is slow
+var appKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+
+// githubStandIn answers the app and repository requests of the tests,
+// the app is installed on the octocat organization and the hubot user
+type githubStandIn struct {
+	t        *testing.T
+	now      time.Time
+	lifetime time.Duration
+	// minted counts the tokens minted for each installation
+	minted map[string]int
+}
+
+func (s *githubStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v3")
+	switch {
+	case path == "/orgs/octocat/installation":
+		s.verifyJWT(r)
+		fmt.Fprint(w, `{"id": 1}`)
+	case path == "/users/hubot/installation":
+		s.verifyJWT(r)
+		fmt.Fprint(w, `{"id": 2}`)
+	case strings.HasPrefix(path, "/app/installations/") && r.Method == http.MethodPost:
+		s.verifyJWT(r)
+		installation := strings.Split(path, "/")[3]
+		s.minted[installation]++
+		fmt.Fprintf(w, `{"token": "token-%s-%d", "expires_at": %q}`,
+			installation, s.minted[installation], s.now.Add(s.lifetime).Format(time.RFC3339))
+	case strings.HasPrefix(path, "/repos/") || strings.HasPrefix(path, "/teams/"):
+		fmt.Fprintf(w, `{"full_name": %q}`, r.Header.Get("Authorization"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Not Found"}`)
+	}
+}
+
+// verifyJWT fails the test, from the goroutine of the server, unless the request is authenticated as the
+// app with a token signed by its key
+func (s *githubStandIn) verifyJWT(r *http.Request) {
+	jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(jwt, ".")
+	if !assert.Len(s.t, parts, 3) {
+		return
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	assert.NoError(s.t, err)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.NoError(s.t, rsa.VerifyPKCS1v15(&appKey.PublicKey, crypto.SHA256, digest[:], signature))
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.NoError(s.t, err)
+	var claims struct {
+		IAT int64 `json:"iat"`
+		EXP int64 `json:"exp"`
+		ISS int64 `json:"iss"`
+	}
+	assert.NoError(s.t, json.Unmarshal(data, &claims))
+	assert.Equal(s.t, int64(42), claims.ISS)
+	assert.True(s.t, claims.IAT <= s.now.Unix())
+	assert.True(s.t, claims.EXP-claims.IAT <= int64(10*time.Minute/time.Second))
+}
+
+func newStandIn(t *testing.T) (*httptest.Server, *githubStandIn, *App) {
+	standIn := &githubStandIn{
+		t:        t,
+		now:      time.Now().Truncate(time.Second),
+		lifetime: time.Hour,
+		minted:   map[string]int{},
+	}
+	server := httptest.NewServer(standIn)
+	app, err := New(server.URL+"/api/v3", 42, appKey)
+	require.NoError(t, err)
+	app.now = func() time.Time { return standIn.now }
+	return server, standIn, app
+}
+
+// authorization returns the authorization header of a repository
+// request made by the github client, echoed by the stand-in
+func authorization(t *testing.T, client *github.Client, owner string) string {
+	repo, _, err := client.Repositories.Get(noContext, owner, "hello-world")
+	require.NoError(t, err)
+	return repo.GetFullName()
+}
+
+func TestAppClient(t *testing.T) {
+	server, standIn, app := newStandIn(t)
+	defer server.Close()
+	client, err := github.NewEnterpriseClient(server.URL+"/api/v3/", server.URL+"/api/v3/", app.Client("octocat"))
+	require.NoError(t, err)
+
+	// each owner gets the token of its installation, which is reused
+	require.Equal(t, "token token-1-1", authorization(t, client, "octocat"))
+	require.Equal(t, "token token-1-1", authorization(t, client, "OctoCat"))
+	require.Equal(t, "token token-2-1", authorization(t, client, "hubot"))
+	require.Equal(t, map[string]int{"1": 1, "2": 1}, standIn.minted)
+
+	// requests without an owner use the default owner
+	req, err := client.NewRequest(http.MethodGet, "teams/1/memberships/hubot", nil)
+	require.NoError(t, err)
+	var membership github.Repository
+	_, err = client.Do(noContext, req, &membership)
+	require.NoError(t, err)
+	require.Equal(t, "token token-1-1", membership.GetFullName())
+
+	// tokens are refreshed before they expire
+	standIn.now = standIn.now.Add(56 * time.Minute)
+	require.Equal(t, "token token-1-2", authorization(t, client, "octocat"))
+	require.Equal(t, map[string]int{"1": 2, "2": 1}, standIn.minted)
+}
+
+func TestAppNotInstalled(t *testing.T) {
+	server, _, app := newStandIn(t)
+	defer server.Close()
+	_, err := app.Token(noContext, "acme")
+	require.EqualError(t, err, "github app installation for acme: app is not installed")
+}
+
+func TestLoadPrivateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "githubapp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(appKey)
+	require.NoError(t, err)
+	tests := []struct {
+		name  string
+		block *pem.Block
+	}{
+		{"pkcs1", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(appKey)}},
+		{"pkcs8", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(dir, test.name+".pem")
+			require.NoError(t, ioutil.WriteFile(file, pem.EncodeToMemory(test.block), 0600))
+			key, err := LoadPrivateKey(file)
+			require.NoError(t, err)
+			require.Equal(t, appKey.PublicKey, key.PublicKey)
+			require.Equal(t, 0, appKey.D.Cmp(key.D))
+		})
+	}
+
+	file := filepath.Join(dir, "empty.pem")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	_, err = LoadPrivateKey(file)
+	require.EqualError(t, err, file+": no PEM encoded key")
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"flag"
+	"os"
 	"sync"
 	"time"
 
@@ -26,6 +28,69 @@ type spec struct {
 	Endpoint      string `envconfig:"DRONE_GITHUB_ENDPOINT" default:"https://api.github.com/"`
 	Org           string `envconfig:"DRONE_GITHUB_ORG"`
 	Team          string `envconfig:"DRONE_GITHUB_TEAM"`
+	// github app used instead of the token, authenticating as the
+	// installation of the owner of each repository
+	AppID         int64  `envconfig:"DRONE_GITHUB_APP_ID"`
+	AppPrivateKey string `envconfig:"DRONE_GITHUB_APP_PRIVATE_KEY_FILE"`
+	// retries of github requests failing on rate limits or server errors
+	Retries int `envconfig:"DRONE_GITHUB_RETRIES" default:"3"`
+
+	// source control api used for path filtering: github, gitlab, gitea or bitbucket,
+	// the gitlab, gitea and bitbucket drivers need an endpoint
+	SCMDriver   string `envconfig:"DRONE_SCM_DRIVER" default:"github"`
+	SCMEndpoint string `envconfig:"DRONE_SCM_ENDPOINT"`
+	SCMToken    string `envconfig:"DRONE_SCM_TOKEN"`
+
+	// changed files used for path filtering: api, git or static
+	ChangedFiles       string   `envconfig:"DRONE_CHANGED_FILES_PROVIDER" default:"api"`
+	GitMirrorPath      string   `envconfig:"DRONE_GIT_MIRROR_PATH" default:"/var/lib/drone/mirrors"`
+	StaticChangedFiles []string `envconfig:"DRONE_CHANGED_FILES"`
+
+	// handling of pipelines depending on skipped pipelines: cascade, drop-edge or fail
+	DependencyPolicy string `envconfig:"DRONE_PATHS_DEPENDENCY_POLICY" default:"cascade"`
+	// remove skipped pipelines and steps instead of excluding them
+	RemoveSkipped bool `envconfig:"DRONE_PATHS_REMOVE_SKIPPED"`
+	// yaml file of path sets available to every repository
+	PathSetsFile string `envconfig:"DRONE_PATHS_SETS_FILE"`
+	// run every pipeline when the changed files cannot be listed
+	FailOpen bool `envconfig:"DRONE_PATHS_FAIL_OPEN"`
+	// explain the skipped pipelines and steps in the first step of each
+	// pipeline, and keep the decisions of the last conversions of each
+	// repository for /debug/paths, which is disabled by default and only
+	// answers requests signed with the secret
+	Explain   bool `envconfig:"DRONE_PATHS_EXPLAIN"`
+	Decisions int  `envconfig:"DRONE_PATHS_DECISIONS"`
+
+	// path conditions for events without changes, keyed by event: run or
+	// last-success, the last successful builds are looked up through the
+	// drone api
+	EventPolicies map[string]string `envconfig:"DRONE_PATHS_EVENT_POLICIES"`
+	HistoryDepth  int               `envconfig:"DRONE_PATHS_HISTORY_DEPTH" default:"50"`
+	DroneEndpoint string            `envconfig:"DRONE_API_ENDPOINT"`
+	DroneToken    string            `envconfig:"DRONE_API_TOKEN"`
+
+	// storage of the cache blocks: s3, minio, gcs, azure or volume, a
+	// cache can name another backend
+	CacheBackend  string `envconfig:"DRONE_CACHE_BACKEND" default:"s3"`
+	CacheEndpoint string `envconfig:"DRONE_CACHE_ENDPOINT"`
+	CacheVolume   string `envconfig:"DRONE_CACHE_VOLUME" default:"/var/cache/drone"`
+
+	// converter error handling
+	ErrorPolicy   string            `envconfig:"DRONE_CONVERT_ERROR_POLICY" default:"fail"`
+	ErrorPolicies map[string]string `envconfig:"DRONE_CONVERT_ERROR_POLICIES"`
+	// time allowed for a conversion, shorter than the timeout of drone
+	// so that retried requests give up first
+	ConvertTimeout time.Duration `envconfig:"DRONE_CONVERT_TIMEOUT" default:"50s"`
+
+	// converter enablement, keyed by converter name with "|" separated values
+	ConvertRepos      map[string]string `envconfig:"DRONE_CONVERT_REPOS"`
+	ConvertNamespaces map[string]string `envconfig:"DRONE_CONVERT_NAMESPACES"`
+	ConvertOptIn      []string          `envconfig:"DRONE_CONVERT_OPT_IN"`
+
+	// conversion result cache, a size of 0 disables it
+	ConvertCacheSize int           `envconfig:"DRONE_CONVERT_CACHE_SIZE" default:"1000"`
+	ConvertCacheTTL  time.Duration `envconfig:"DRONE_CONVERT_CACHE_TTL" default:"1h"`
+	ConvertCachePath string        `envconfig:"DRONE_CONVERT_CACHE_PATH"`
 
 	// gc settings
 	UseGC      bool          `envconfig:"DRONE_USE_GC"`
@@ -34,14 +99,31 @@ type spec struct {
 	Interval   time.Duration `envconfig:"DRONE_GC_INTERVAL" default:"5m"`
 	Cache      string        `envconfig:"DRONE_GC_CACHE" default:"5gb"`
 
-	// runner settings
-	UseRunner    bool `envconfig:"DRONE_USE_RUNNER"`
-	RunnerConfig runner.Config
+	// runner settings, only read when the runner is used
+	UseRunner    bool          `envconfig:"DRONE_USE_RUNNER"`
+	RunnerConfig runner.Config `ignored:"true" json:"-"`
 }
 
-func main() {
+// loadSpec reads the settings from the environment, along with the
+// required runner settings when the runner is used
+func loadSpec(useRunner bool) (*spec, error) {
 	spec := new(spec)
-	err := envconfig.Process("", spec)
+	if err := envconfig.Process("", spec); err != nil {
+		return nil, err
+	}
+	if useRunner && spec.UseRunner {
+		if err := envconfig.Process("", &spec.RunnerConfig); err != nil {
+			return nil, err
+		}
+	}
+	return spec, nil
+}
+
+func main() {
+	// the convert subcommand renders a configuration offline and does
+	// not need the runner settings
+	convert := len(os.Args) > 1 && os.Args[1] == "convert"
+	spec, err := loadSpec(!convert)
 	if err != nil {
 		logrus.Fatal(err)
 	}
@@ -55,6 +137,15 @@ func main() {
 
 	ctx := signal.WithContext(log.Logger.WithContext(context.Background()))
 
+	if convert {
+		if err := runConvert(ctx, spec, os.Args[2:], os.Stdout); err != nil {
+			if err != flag.ErrHelp {
+				logrus.Fatal(err)
+			}
+		}
+		return
+	}
+
 	var wg sync.WaitGroup
 	if spec.UseExtensions {
 		if spec.Secret == "" {
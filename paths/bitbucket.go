@@ -0,0 +1,78 @@
+package paths
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/drone/drone-go/drone"
+)
+
+// NewBitbucketProvider returns a provider that queries the Bitbucket
+// Server api at the endpoint, e.g. https://bitbucket.example.com
+func NewBitbucketProvider(endpoint, token string) ChangedFilesProvider {
+	value := ""
+	if token != "" {
+		value = "Bearer " + token
+	}
+	return &bitbucketProvider{
+		api: newAPIClient(endpoint, "Authorization", value),
+	}
+}
+
+// pullRequestRef matches the refs of Bitbucket Server pull requests
+var pullRequestRef = regexp.MustCompile(`^refs/pull-requests/(\d+)/`)
+
+type bitbucketProvider struct {
+	api *apiClient
+}
+
+type bitbucketPath struct {
+	ToString string `json:"toString"`
+}
+
+type bitbucketChanges struct {
+	Values []struct {
+		Path    bitbucketPath `json:"path"`
+		SrcPath bitbucketPath `json:"srcPath"`
+		Type    string        `json:"type"`
+	} `json:"values"`
+	IsLastPage    bool `json:"isLastPage"`
+	NextPageStart int  `json:"nextPageStart"`
+}
+
+func (p *bitbucketProvider) ChangedFiles(ctx context.Context, repo drone.Repo, build drone.Build) ([]File, error) {
+	path := "/rest/api/1.0/projects/" + url.PathEscape(repo.Namespace) + "/repos/" + url.PathEscape(repo.Name)
+	query := url.Values{
+		"limit": {strconv.Itoa(1000)},
+	}
+	if match := pullRequestRef.FindStringSubmatch(build.Ref); build.Event == drone.EventPullRequest && match != nil {
+		// the changes api diffs the commits directly, the pull request
+		// changes are relative to the merge-base like the other providers
+		path += "/pull-requests/" + match[1] + "/changes"
+	} else {
+		path += "/changes"
+		query.Set("until", build.After)
+		// without a since commit the changes are relative to the parent
+		if !isZeroCommit(build.Before) {
+			query.Set("since", build.Before)
+		}
+	}
+
+	files := &fileSet{}
+	for start := 0; ; {
+		query.Set("start", strconv.Itoa(start))
+		changes := bitbucketChanges{}
+		if _, err := p.api.get(ctx, path, query, &changes); err != nil {
+			return nil, err
+		}
+		for _, change := range changes.Values {
+			files.add(newFile(change.Path.ToString, change.SrcPath.ToString, change.Type))
+		}
+		if changes.IsLastPage || changes.NextPageStart <= start {
+			return files.files, nil
+		}
+		start = changes.NextPageStart
+	}
+}
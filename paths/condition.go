@@ -1,12 +1,50 @@
 package paths
 
 import (
+	"fmt"
+	"path"
+	"strings"
+
 	filepath "github.com/bmatcuk/doublestar"
+	"gopkg.in/yaml.v3"
 )
 
 type condition struct {
 	Exclude []string `yaml:"exclude,omitempty"`
 	Include []string `yaml:"include,omitempty"`
+	// Status limits the condition to files added, modified, removed or renamed
+	Status []string `yaml:"status,omitempty"`
+
+	// Any, All and None combine patterns and nested conditions, see match
+	Any  []expression `yaml:"any,omitempty"`
+	All  []expression `yaml:"all,omitempty"`
+	None []expression `yaml:"none,omitempty"`
+
+	// IgnoreIfOnly skips when every changed file matches these patterns
+	IgnoreIfOnly []string `yaml:"ignore_if_only,omitempty"`
+
+	// Root is the directory that the patterns of a pipeline trigger and
+	// of the steps of the pipeline are relative to
+	Root string `yaml:"root,omitempty"`
+}
+
+// expression is an item of an any, all or none group, either a glob
+// pattern or a nested condition
+type expression struct {
+	Pattern   string
+	Condition *condition
+}
+
+func (e *expression) UnmarshalYAML(value *yaml.Node) error {
+	node := value
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&e.Pattern)
+	}
+	e.Condition = &condition{}
+	return node.Decode(e.Condition)
 }
 
 func (c *condition) HasIncludes() bool {
@@ -17,9 +55,160 @@ func (c *condition) HasExcludes() bool {
 	return len(c.Exclude) > 0
 }
 
-// match returns true if the string matches the include
+func (c *condition) HasStatus() bool {
+	return len(c.Status) > 0
+}
+
+func (c *condition) HasGroups() bool {
+	return len(c.Any) > 0 || len(c.All) > 0 || len(c.None) > 0 || len(c.IgnoreIfOnly) > 0
+}
+
+// IsSet returns true if the condition filters on the changed files
+func (c *condition) IsSet() bool {
+	return c.HasIncludes() || c.HasExcludes() || c.HasStatus() || c.HasGroups() || len(c.IgnoreIfOnly) > 0
+}
+
+// under makes the patterns of the condition and of its nested
+// conditions relative to the root directory, by prefixing them with it
+// as they are, so a pattern matches the same files under the root as it
+// would at the top of the repository
+func (c *condition) under(root string) error {
+	var err error
+	if c.Include, err = underRoot(root, c.Include); err != nil {
+		return err
+	}
+	if c.Exclude, err = underRoot(root, c.Exclude); err != nil {
+		return err
+	}
+	if c.IgnoreIfOnly, err = underRoot(root, c.IgnoreIfOnly); err != nil {
+		return err
+	}
+	for _, group := range [][]expression{c.Any, c.All, c.None} {
+		for i := range group {
+			if group[i].Condition != nil {
+				if err := group[i].Condition.under(root); err != nil {
+					return err
+				}
+				continue
+			}
+			if leavesRoot(group[i].Pattern) {
+				return &rootError{root: root, pattern: group[i].Pattern}
+			}
+			group[i].Pattern = root + "/" + group[i].Pattern
+		}
+	}
+	return nil
+}
+
+func underRoot(root string, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return patterns, nil
+	}
+	prefixed := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		if leavesRoot(pattern) {
+			return nil, &rootError{root: root, pattern: pattern}
+		}
+		prefixed[i] = root + "/" + pattern
+	}
+	return prefixed, nil
+}
+
+// leavesRoot returns true if the pattern has a .. segment, patterns are
+// prefixed with the root without being cleaned so such a pattern could
+// never match a changed file
+func leavesRoot(pattern string) bool {
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// rootError is returned for a pattern reaching outside of the root
+type rootError struct {
+	root    string
+	pattern string
+	// line is the line of the root in the configuration
+	line int
+}
+
+func (e *rootError) Error() string {
+	return fmt.Sprintf("pattern %q leaves the root %s", e.pattern, e.root)
+}
+
+// cleanRoot returns the root directory relative to the repository, and
+// false if it is the repository itself
+func cleanRoot(root string) (string, bool) {
+	root = strings.Trim(path.Clean("/"+root), "/")
+	return root, root != ""
+}
+
+// match returns true if the changed files satisfy every part of the
+// condition:
+//
+//   - include, exclude and status: some file matches them
+//   - any: some file matches one of the patterns, or a nested condition matches
+//   - all: every file matches one of the patterns, and every nested condition matches
+//   - none: no file matches the patterns, and no nested condition matches
+//   - ignore_if_only: some file does not match the patterns
+//
+// A condition that does not filter on the changed files always matches,
+// even when nothing changed.
+func (c *condition) match(files []File) bool {
+	if !c.IsSet() {
+		return true
+	}
+	if c.HasIncludes() || c.HasExcludes() || c.HasStatus() || !c.HasGroups() {
+		if !someFile(files, c.matchFile) {
+			return false
+		}
+	}
+	if len(c.Any) > 0 && !matchAny(c.Any, files) {
+		return false
+	}
+	if len(c.All) > 0 && !matchAll(c.All, files) {
+		return false
+	}
+	if len(c.None) > 0 && matchAny(c.None, files) {
+		return false
+	}
+	if len(c.IgnoreIfOnly) > 0 && !someFile(files, c.notIgnored) {
+		return false
+	}
+	return true
+}
+
+// notIgnored returns true if a name of the file does not match the
+// ignore_if_only patterns, so a file renamed out of an ignored
+// directory still counts as a change
+func (c *condition) notIgnored(f File) bool {
+	for _, name := range f.names() {
+		if !matchPatterns(c.IgnoreIfOnly, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFile returns true if the file has one of the statuses and
+// either of its names matches the include and exclude patterns.
+func (c *condition) matchFile(f File) bool {
+	if c.HasStatus() && !contains(c.Status, f.Status) {
+		return false
+	}
+	for _, name := range f.names() {
+		if c.matchName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName returns true if the string matches the include
 // patterns and does not match any of the exclude patterns.
-func (c *condition) match(v string) bool {
+func (c *condition) matchName(v string) bool {
 	if c.excludes(v) {
 		return false
 	}
@@ -35,18 +224,87 @@ func (c *condition) match(v string) bool {
 // includes returns true if the string matches the include
 // patterns.
 func (c *condition) includes(v string) bool {
-	for _, pattern := range c.Include {
-		if ok, _ := filepath.Match(pattern, v); ok {
+	return matchPatterns(c.Include, v)
+}
+
+// excludes returns true if the string matches the exclude
+// patterns.
+func (c *condition) excludes(v string) bool {
+	return matchPatterns(c.Exclude, v)
+}
+
+// matchAny returns true if some file matches one of the patterns of
+// the group or one of its nested conditions matches
+func matchAny(group []expression, files []File) bool {
+	patterns, conditions := split(group)
+	if len(patterns) > 0 && someFile(files, fileMatcher(patterns)) {
+		return true
+	}
+	for _, c := range conditions {
+		if c.match(files) {
 			return true
 		}
 	}
 	return false
 }
 
-// excludes returns true if the string matches the exclude
-// patterns.
-func (c *condition) excludes(v string) bool {
-	for _, pattern := range c.Exclude {
+// matchAll returns true if every file matches one of the patterns of
+// the group and all of its nested conditions match
+func matchAll(group []expression, files []File) bool {
+	patterns, conditions := split(group)
+	if len(patterns) > 0 {
+		matcher := fileMatcher(patterns)
+		for _, f := range files {
+			if !matcher(f) {
+				return false
+			}
+		}
+	}
+	for _, c := range conditions {
+		if !c.match(files) {
+			return false
+		}
+	}
+	return true
+}
+
+func split(group []expression) ([]string, []*condition) {
+	patterns := []string{}
+	conditions := []*condition{}
+	for _, e := range group {
+		if e.Condition != nil {
+			conditions = append(conditions, e.Condition)
+		} else {
+			patterns = append(patterns, e.Pattern)
+		}
+	}
+	return patterns, conditions
+}
+
+// fileMatcher returns a function matching files where either of
+// the names matches one of the patterns
+func fileMatcher(patterns []string) func(File) bool {
+	return func(f File) bool {
+		for _, name := range f.names() {
+			if matchPatterns(patterns, name) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func someFile(files []File, match func(File) bool) bool {
+	for _, f := range files {
+		if match(f) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPatterns(patterns []string, v string) bool {
+	for _, pattern := range patterns {
 		if ok, _ := filepath.Match(pattern, v); ok {
 			return true
 		}
@@ -55,6 +313,37 @@ func (c *condition) excludes(v string) bool {
 }
 
 type conditions struct {
-	Paths condition              `yaml:"paths,omitempty"`
-	Attrs map[string]interface{} `yaml:",inline"`
+	Paths condition `yaml:"paths,omitempty"`
+	// GoPackages adds the files of the packages and of their
+	// dependencies within the repository to the included paths
+	GoPackages []string `yaml:"go_packages,omitempty"`
+}
+
+// IsSet returns true if the conditions filter on the changed files
+func (c *conditions) IsSet() bool {
+	return c.Paths.IsSet() || len(c.GoPackages) > 0
+}
+
+// under makes the paths and go packages of the conditions relative to
+// the root directory
+func (c *conditions) under(root string) error {
+	if err := c.Paths.under(root); err != nil {
+		return err
+	}
+	for i, pattern := range c.GoPackages {
+		if leavesRoot(pattern) {
+			return &rootError{root: root, pattern: pattern}
+		}
+		c.GoPackages[i] = "./" + path.Join(root, pattern)
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,86 @@
+package paths
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestConditionMatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+		files     []string
+		match     bool
+	}{
+		{"include", `include: [src/**]`, []string{"docs/a.md", "src/a.go"}, true},
+		{"exclude", `exclude: ["**/*.md"]`, []string{"docs/a.md"}, false},
+		{"any pattern", `any: [src/**, lib/**]`, []string{"lib/a.go"}, true},
+		{"any miss", `any: [src/**]`, []string{"lib/a.go"}, false},
+		{"all", `all: [docs/**]`, []string{"docs/a.md", "docs/b.md"}, true},
+		{"all miss", `all: [docs/**]`, []string{"docs/a.md", "src/a.go"}, false},
+		{"none", `none: [docs/**]`, []string{"src/a.go"}, true},
+		{"none miss", `none: [docs/**]`, []string{"docs/a.md", "src/a.go"}, false},
+		{"not only docs", `none: [{all: [docs/**]}]`, []string{"docs/a.md", "src/a.go"}, true},
+		{"only docs", `none: [{all: [docs/**]}]`, []string{"docs/a.md"}, false},
+		{"groups are combined", `{any: [src/**], none: [{all: ["**/*.md"]}]}`, []string{"src/README.md"}, false},
+		{"nested all", `any: [{all: [{include: [src/**]}, {include: [test/**]}]}]`, []string{"src/a.go", "test/a.go"}, true},
+		{"nested all miss", `any: [{all: [{include: [src/**]}, {include: [test/**]}]}]`, []string{"src/a.go"}, false},
+		{"ignore if only", `ignore_if_only: ["**/*.md", "*.lock"]`, []string{"README.md", "yarn.lock"}, false},
+		{"ignore if only miss", `ignore_if_only: ["**/*.md"]`, []string{"README.md", "yarn.lock"}, true},
+		{"exclude runs on any other file", `exclude: ["**/*.md"]`, []string{"README.md", "yarn.lock"}, true},
+		{"ignore if only and include", `{include: [web/**], ignore_if_only: ["**/*.md"]}`, []string{"web/README.md"}, false},
+		{"legacy and group", `{include: [src/**], none: [src/vendor/**]}`, []string{"src/a.go", "src/vendor/b.go"}, false},
+		{"unset without changes", `{}`, nil, true},
+		{"include without changes", `include: ["**"]`, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := condition{}
+			require.NoError(t, yaml.Unmarshal([]byte(test.condition), &c))
+			files := []File{}
+			for _, name := range test.files {
+				files = append(files, newFile(name, "", StatusModified))
+			}
+			require.Equal(t, test.match, c.match(files))
+		})
+	}
+}
+
+func TestConditionUnder(t *testing.T) {
+	c := conditions{}
+	require.NoError(t, yaml.Unmarshal([]byte(`{
+  paths: {include: ["**/*.go"], exclude: [testdata/**], any: [{all: [docs/**]}]},
+  go_packages: [./cmd/api, ./...],
+}`), &c))
+	root, ok := cleanRoot("./services/api/")
+	require.True(t, ok)
+	require.NoError(t, c.under(root))
+	require.Equal(t, []string{"services/api/**/*.go"}, c.Paths.Include)
+	require.Equal(t, []string{"services/api/testdata/**"}, c.Paths.Exclude)
+	require.Equal(t, "services/api/docs/**", c.Paths.Any[0].Condition.All[0].Pattern)
+	require.Equal(t, []string{"./services/api/cmd/api", "./services/api/..."}, c.GoPackages)
+
+	_, ok = cleanRoot("./")
+	require.False(t, ok)
+}
+
+func TestConditionUnderLeavesRoot(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions string
+		err        string
+	}{
+		{"exclude", `paths: {exclude: [../shared/testdata/**]}`, `pattern "../shared/testdata/**" leaves the root services/api`},
+		{"nested", `paths: {none: [{all: [docs/../../**]}]}`, `pattern "docs/../../**" leaves the root services/api`},
+		{"go packages", `go_packages: [../shared/...]`, `pattern "../shared/..." leaves the root services/api`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := conditions{}
+			require.NoError(t, yaml.Unmarshal([]byte(test.conditions), &c))
+			require.EqualError(t, c.under("services/api"), test.err)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package paths
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
+	"gopkg.in/yaml.v3"
+)
+
+// DependencyPolicy determines what happens to the pipelines that
+// depend on a pipeline skipped by its path conditions
+type DependencyPolicy int
+
+const (
+	// DependencyCascade skips the dependents as well
+	DependencyCascade DependencyPolicy = iota
+	// DependencyDropEdge runs the dependents without waiting on the
+	// skipped pipeline
+	DependencyDropEdge
+	// DependencyFail fails the conversion
+	DependencyFail
+)
+
+// ParseDependencyPolicy parses a dependency policy name
+func ParseDependencyPolicy(s string) (DependencyPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "cascade":
+		return DependencyCascade, nil
+	case "drop-edge", "dropedge":
+		return DependencyDropEdge, nil
+	case "fail":
+		return DependencyFail, nil
+	}
+	return DependencyCascade, fmt.Errorf("unknown dependency policy %q", s)
+}
+
+// skippedDependencyError is returned by the fail policy
+type skippedDependencyError struct {
+	pipeline string
+	skipped  []string
+}
+
+func (e *skippedDependencyError) Error() string {
+	return fmt.Sprintf("depends on skipped pipelines: %s", strings.Join(e.skipped, ", "))
+}
+
+// resolveDependencies applies the policy to every pipeline whose
+// depends_on names a skipped pipeline, and returns the pipelines
+// that were changed
+func resolveDependencies(pipelines []*pipeline, policy DependencyPolicy) ([]*pipeline, error) {
+	skipped := map[string]bool{}
+	for _, p := range pipelines {
+		if p.skipped {
+			skipped[p.Name] = true
+		}
+	}
+	updated := []*pipeline{}
+	// cascading can skip a pipeline that others depend on, so keep
+	// going until the graph settles, which also copes with cycles
+	for changed := true; changed; {
+		changed = false
+		for _, p := range pipelines {
+			if p.skipped {
+				continue
+			}
+			dependencies := p.skippedDependencies(skipped)
+			if len(dependencies) == 0 {
+				continue
+			}
+			switch policy {
+			case DependencyFail:
+				return nil, &skippedDependencyError{pipeline: p.Name, skipped: dependencies}
+			case DependencyDropEdge:
+				p.dropDependencies(skipped)
+			case DependencyCascade:
+				p.skip()
+				skipped[p.Name] = true
+				changed = true
+			}
+			updated = append(updated, p)
+		}
+	}
+	return updated, nil
+}
+
+// skippedDependencies returns the names in depends_on that are skipped
+func (p *pipeline) skippedDependencies(skipped map[string]bool) []string {
+	dependencies := []string{}
+	for _, dependency := range p.DependsOn {
+		if skipped[dependency] {
+			dependencies = append(dependencies, dependency)
+		}
+	}
+	return dependencies
+}
+
+// dropDependencies removes the skipped pipelines from depends_on,
+// keeping the original list so that it can be restored unless the
+// skipped pipelines are removed
+func (p *pipeline) dropDependencies(skipped map[string]bool) {
+	root := p.doc.Root()
+	if !p.remove {
+		document.Stash(root, name, "depends_on")
+	}
+	dependsOn := &yaml.Node{Kind: yaml.SequenceNode}
+	kept := []string{}
+	for _, dependency := range p.DependsOn {
+		if skipped[dependency] {
+			continue
+		}
+		dependsOn.Content = append(dependsOn.Content, document.Scalar(dependency))
+		kept = append(kept, dependency)
+	}
+	document.Set(root, "depends_on", dependsOn)
+	p.DependsOn = kept
+	p.doc.Touch()
+}
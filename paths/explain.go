@@ -0,0 +1,194 @@
+package paths
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
+	"github.com/drone/drone-go/drone"
+	"gopkg.in/yaml.v3"
+)
+
+// explainVariable is the environment variable of the first step of a
+// pipeline holding the decisions made for the pipeline
+const explainVariable = "DRONE_PATHS_MATCHED"
+
+// Decision explains why a pipeline or step runs or is skipped
+type Decision struct {
+	Pipeline string `json:"pipeline"`
+	// Step is empty for the decision about the pipeline trigger
+	Step string `json:"step,omitempty"`
+	Run  bool   `json:"run"`
+	// Matched are the patterns that some changed file matches, and
+	// Unmatched the ones no changed file matches
+	Matched   []string `json:"matched,omitempty"`
+	Unmatched []string `json:"unmatched,omitempty"`
+	// Files are the changed files satisfying the condition
+	Files []string `json:"files,omitempty"`
+}
+
+// explain returns the decision for the conditions
+func (c *conditions) explain(pipeline, step string, files []File) Decision {
+	decision := Decision{
+		Pipeline: pipeline,
+		Step:     step,
+		Run:      c.Paths.match(files),
+	}
+	if !c.IsSet() {
+		return decision
+	}
+	for _, pattern := range c.Paths.patterns() {
+		if someFile(files, fileMatcher([]string{pattern})) {
+			decision.Matched = append(decision.Matched, pattern)
+		} else {
+			decision.Unmatched = append(decision.Unmatched, pattern)
+		}
+	}
+	for _, f := range files {
+		if c.Paths.satisfiedBy(f) {
+			decision.Files = append(decision.Files, f.Name)
+		}
+	}
+	return decision
+}
+
+// patterns returns every pattern of the condition and its nested
+// conditions, without duplicates
+func (c *condition) patterns() []string {
+	patterns := []string{}
+	seen := map[string]bool{}
+	var add func(c *condition)
+	add = func(c *condition) {
+		all := append(append(append([]string{}, c.Include...), c.Exclude...), c.IgnoreIfOnly...)
+		for _, group := range [][]expression{c.Any, c.All, c.None} {
+			groupPatterns, conditions := split(group)
+			all = append(all, groupPatterns...)
+			for _, nested := range conditions {
+				add(nested)
+			}
+		}
+		for _, pattern := range all {
+			if !seen[pattern] {
+				seen[pattern] = true
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	add(c)
+	return patterns
+}
+
+// satisfiedBy returns whether the file is one that makes the condition
+// match, as opposed to a file that only happened to change alongside
+func (c *condition) satisfiedBy(f File) bool {
+	if c.HasIncludes() || c.HasExcludes() || c.HasStatus() || !c.HasGroups() {
+		return c.matchFile(f)
+	}
+	if len(c.IgnoreIfOnly) > 0 && c.notIgnored(f) {
+		return true
+	}
+	for _, group := range [][]expression{c.Any, c.All} {
+		patterns, conditions := split(group)
+		if len(patterns) > 0 && fileMatcher(patterns)(f) {
+			return true
+		}
+		for _, nested := range conditions {
+			if nested.satisfiedBy(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// annotate sets the decisions for the pipeline as an environment
+// variable of its first step, leaving out the steps generated by other
+// converters, and keeps the original environment so that it can be
+// restored
+func (p *pipeline) annotate(decisions []Decision) error {
+	steps := document.Ensure(p.doc.Root(), "steps", yaml.SequenceNode)
+	for i, node := range steps.Content {
+		if marker := document.Lookup(node, document.MarkerKey); marker != nil && marker.Kind == yaml.ScalarNode {
+			continue
+		}
+		data, err := json.Marshal(decisions)
+		if err != nil {
+			return err
+		}
+		node = document.Own(steps, i)
+		document.Stash(node, name, "environment")
+		environment := document.Ensure(node, "environment", yaml.MappingNode)
+		document.Set(environment, explainVariable, document.Scalar(string(data)))
+		p.doc.Touch()
+		return nil
+	}
+	return nil
+}
+
+// Report holds the decisions made when converting the configuration
+// of a build
+type Report struct {
+	Time      time.Time  `json:"time"`
+	Build     int64      `json:"build"`
+	Event     string     `json:"event"`
+	After     string     `json:"after"`
+	Decisions []Decision `json:"decisions"`
+}
+
+// Recorder keeps the reports of the last conversions of each
+// repository and serves them as json
+type Recorder struct {
+	size int
+
+	mu      sync.Mutex
+	reports map[string][]Report
+}
+
+// NewRecorder returns a recorder keeping size reports per repository
+func NewRecorder(size int) *Recorder {
+	return &Recorder{
+		size:    size,
+		reports: map[string][]Report{},
+	}
+}
+
+func (r *Recorder) record(repo drone.Repo, build drone.Build, decisions []Decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reports := append(r.reports[repo.Slug], Report{
+		Time:      time.Now(),
+		Build:     build.Number,
+		Event:     build.Event,
+		After:     build.After,
+		Decisions: decisions,
+	})
+	if len(reports) > r.size {
+		reports = reports[len(reports)-r.size:]
+	}
+	r.reports[repo.Slug] = reports
+}
+
+// Reports returns the recorded reports of the repository, newest last
+func (r *Recorder) Reports(slug string) []Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Report{}, r.reports[slug]...)
+}
+
+// ServeHTTP serves the reports of every repository, or of the one in
+// the repo query parameter
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query().Get("repo")
+	result := map[string][]Report{}
+	r.mu.Lock()
+	for slug, reports := range r.reports {
+		if query == "" || query == slug {
+			result[slug] = reports
+		}
+	}
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,70 @@
+package paths
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginExplain(t *testing.T) {
+	before, err := ioutil.ReadFile("testdata/explain.yml")
+	require.NoError(t, err)
+	after, err := ioutil.ReadFile("testdata/explain.yml.golden")
+	require.NoError(t, err)
+
+	recorder := NewRecorder(1)
+	plugin := New(NewStaticProvider("server/main.go", "README.md"), WithExplain(), WithRecorder(recorder))
+	req := &converter.Request{
+		Build:  drone.Build{Number: 7, Event: drone.EventPush, Before: "1", After: "2"},
+		Repo:   drone.Repo{Slug: "octocat/hello-world", Config: ".drone.yml"},
+		Config: drone.Config{Data: string(before)},
+	}
+
+	config, err := plugin.Convert(noContext, req)
+	require.NoError(t, err)
+	require.Equal(t, string(after), config.Data)
+
+	// converting the output again must leave it unchanged
+	req.Config.Data = config.Data
+	config, err = plugin.Convert(noContext, req)
+	require.NoError(t, err)
+	require.Equal(t, string(after), config.Data)
+
+	// only the last report is kept
+	reports := recorder.Reports("octocat/hello-world")
+	require.Len(t, reports, 1)
+	require.Equal(t, int64(7), reports[0].Build)
+	require.Equal(t, []Decision{
+		{
+			Pipeline:  "backend",
+			Run:       true,
+			Matched:   []string{"**/*.go"},
+			Unmatched: []string{"go.sum"},
+			Files:     []string{"server/main.go"},
+		},
+		{
+			Pipeline:  "backend",
+			Step:      "docs",
+			Unmatched: []string{"docs/**"},
+		},
+		{
+			Pipeline:  "frontend",
+			Unmatched: []string{"client/**"},
+		},
+	}, reports[0].Decisions)
+
+	res := httptest.NewRecorder()
+	recorder.ServeHTTP(res, httptest.NewRequest("GET", "/debug/paths?repo=octocat/hello-world", nil))
+	served := map[string][]Report{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&served))
+	require.Len(t, served["octocat/hello-world"], 1)
+
+	res = httptest.NewRecorder()
+	recorder.ServeHTTP(res, httptest.NewRequest("GET", "/debug/paths?repo=octocat/other", nil))
+	require.JSONEq(t, "{}", res.Body.String())
+}
@@ -0,0 +1,68 @@
+package paths
+
+// file statuses that path conditions can filter on
+const (
+	StatusAdded    = "added"
+	StatusModified = "modified"
+	StatusRemoved  = "removed"
+	StatusRenamed  = "renamed"
+)
+
+// File is a file changed by a build
+type File struct {
+	Name string
+	// Previous is the name of a renamed file before the rename
+	Previous string
+	Status   string
+}
+
+// newFile returns a changed file, mapping the statuses used by the
+// source control providers onto the ones path conditions filter on
+func newFile(name, previous, status string) File {
+	switch status {
+	case StatusAdded, "copied", "ADD", "COPY", "A", "C":
+		status = StatusAdded
+	case StatusRemoved, "deleted", "DELETE", "D":
+		status = StatusRemoved
+	case StatusRenamed, "MOVE", "R":
+		status = StatusRenamed
+	default:
+		status = StatusModified
+	}
+	if status != StatusRenamed || previous == name {
+		previous = ""
+	}
+	return File{
+		Name:     name,
+		Previous: previous,
+		Status:   status,
+	}
+}
+
+// names returns the names that path patterns are matched against, a
+// renamed file matches on both its previous and its new name
+func (f File) names() []string {
+	if f.Previous != "" {
+		return []string{f.Previous, f.Name}
+	}
+	return []string{f.Name}
+}
+
+// fileSet collects changed files without duplicates, in the order
+// they were first seen
+type fileSet struct {
+	files []File
+	seen  map[File]bool
+}
+
+func (s *fileSet) add(files ...File) {
+	if s.seen == nil {
+		s.seen = map[File]bool{}
+	}
+	for _, file := range files {
+		if file.Name != "" && !s.seen[file] {
+			s.seen[file] = true
+			s.files = append(s.files, file)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package paths
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/drone/drone-go/drone"
+)
+
+// TokenSource returns the token authenticating the requests for the
+// repositories of the owner, like the installation token of a GitHub App
+type TokenSource func(ctx context.Context, owner string) (string, error)
+
+// StaticToken returns a token source with the same token for every
+// owner, an empty token leaves the requests unauthenticated
+func StaticToken(token string) TokenSource {
+	return func(context.Context, string) (string, error) {
+		return token, nil
+	}
+}
+
+// NewGitMirror returns a provider that keeps a bare mirror of every
+// repository under dir, fetching it when a build refers to commits it
+// does not have yet and diffing the commits locally. The tokens of the
+// owners of the repositories authenticate the clones and fetches from
+// the host, like https://github.com, and are passed to git through its
+// environment rather than its arguments, which needs git 2.31 or later.
+func NewGitMirror(dir, host string, tokens TokenSource) ChangedFilesProvider {
+	return &gitProvider{
+		dir:    dir,
+		host:   strings.TrimSuffix(host, "/") + "/",
+		tokens: tokens,
+		locks:  map[string]*sync.Mutex{},
+	}
+}
+
+// NewGitRepository returns a provider that diffs the commits in an
+// existing local repository, without fetching
+func NewGitRepository(dir string) ChangedFilesProvider {
+	return &gitProvider{
+		repository: dir,
+	}
+}
+
+type gitProvider struct {
+	// repository is a fixed local repository
+	repository string
+
+	// dir is the directory holding the mirrors, and the tokens
+	// authenticate the requests to the host
+	dir    string
+	host   string
+	tokens TokenSource
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (p *gitProvider) ChangedFiles(ctx context.Context, repo drone.Repo, build drone.Build) ([]File, error) {
+	dir, release, err := p.open(ctx, repo, build)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var out string
+	if isZeroCommit(build.Before) {
+		// like the scm apis, diff merge commits from their first parent
+		// rather than print the combined diff of their parents
+		out, err = p.git(ctx, dir, "show", "-m", "--first-parent", "--format=", "--name-status", "-M", "-z", build.After)
+	} else {
+		// like the scm apis, diff from the merge-base of the commits
+		out, err = p.git(ctx, dir, "diff", "--name-status", "-M", "-z", build.Before+"..."+build.After)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseNameStatus(out), nil
+}
+
+// GoSources reads the go.mod and go files at the commit of the build
+func (p *gitProvider) GoSources(ctx context.Context, repo drone.Repo, build drone.Build) (map[string][]byte, error) {
+	dir, release, err := p.open(ctx, repo, build)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	out, err := p.git(ctx, dir, "ls-tree", "-r", "-z", "--name-only", build.After)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	var objects strings.Builder
+	for _, name := range strings.Split(out, "\x00") {
+		if isGoSource(name) && !strings.Contains(name, "\n") {
+			names = append(names, name)
+			fmt.Fprintf(&objects, "%s:%s\n", build.After, name)
+		}
+	}
+	out, err = p.run(ctx, dir, strings.NewReader(objects.String()), nil, "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	return parseBatch(out, names)
+}
+
+// parseBatch parses the output of git cat-file --batch, which is made
+// of a header with the size of each object followed by its content
+func parseBatch(out string, names []string) (map[string][]byte, error) {
+	sources := map[string][]byte{}
+	for _, name := range names {
+		end := strings.Index(out, "\n")
+		if end < 0 {
+			return nil, fmt.Errorf("git cat-file: missing object %s", name)
+		}
+		header := strings.Fields(out[:end])
+		if len(header) != 3 {
+			return nil, fmt.Errorf("git cat-file: unexpected header %q", out[:end])
+		}
+		size, err := strconv.Atoi(header[2])
+		if err != nil || end+1+size > len(out) {
+			return nil, fmt.Errorf("git cat-file: unexpected header %q", out[:end])
+		}
+		sources[name] = []byte(out[end+1 : end+1+size])
+		out = strings.TrimPrefix(out[end+1+size:], "\n")
+	}
+	return sources, nil
+}
+
+// open returns the repository holding the commits of the build, and a
+// function releasing it once the commands using it are done
+func (p *gitProvider) open(ctx context.Context, repo drone.Repo, build drone.Build) (string, func(), error) {
+	if p.repository != "" {
+		return p.repository, func() {}, nil
+	}
+	// builds of the same repository share the mirror
+	lock := p.lock(repo.Slug)
+	lock.Lock()
+	dir, err := p.mirror(ctx, repo, build)
+	if err != nil {
+		lock.Unlock()
+		return "", nil, err
+	}
+	return dir, lock.Unlock, nil
+}
+
+// parseNameStatus parses the output of git --name-status -z, where
+// renames and copies are followed by both the source and the destination
+func parseNameStatus(out string) []File {
+	fields := strings.Split(strings.TrimLeft(out, "\x00\n"), "\x00")
+	files := []File{}
+	for i := 0; i+1 < len(fields) && fields[i] != ""; i += 2 {
+		// the status letter is followed by a similarity score for renames
+		status := fields[i][:1]
+		name, previous := fields[i+1], ""
+		if (status == "R" || status == "C") && i+2 < len(fields) {
+			previous, name = name, fields[i+2]
+			i++
+		}
+		files = append(files, newFile(name, previous, status))
+	}
+	return files
+}
+
+func (p *gitProvider) lock(slug string) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lock, ok := p.locks[slug]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.locks[slug] = lock
+	}
+	return lock
+}
+
+// mirror returns the mirror of the repository, cloning it or fetching
+// it so that it contains the commits of the build
+func (p *gitProvider) mirror(ctx context.Context, repo drone.Repo, build drone.Build) (string, error) {
+	if repo.HTTPURL == "" {
+		return "", fmt.Errorf("repository %s has no clone url", repo.Slug)
+	}
+	dir := filepath.Join(p.dir, filepath.FromSlash(repo.Slug)+".git")
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+			return "", err
+		}
+		_, err := p.remote(ctx, repo, "", "clone", "--mirror", "--quiet", repo.HTTPURL, dir)
+		return dir, err
+	}
+	if p.has(ctx, dir, build.After) && (isZeroCommit(build.Before) || p.has(ctx, dir, build.Before)) {
+		return dir, nil
+	}
+	_, err := p.remote(ctx, repo, dir, "fetch", "--prune", "--quiet", "origin")
+	return dir, err
+}
+
+// has returns whether the repository contains the commit
+func (p *gitProvider) has(ctx context.Context, dir, sha string) bool {
+	_, err := p.git(ctx, dir, "cat-file", "-e", sha+"^{commit}")
+	return err == nil
+}
+
+func (p *gitProvider) git(ctx context.Context, dir string, args ...string) (string, error) {
+	return p.run(ctx, dir, nil, nil, args...)
+}
+
+// remote runs the git command talking to the remote of the repository,
+// authenticated with the token of its owner
+func (p *gitProvider) remote(ctx context.Context, repo drone.Repo, dir string, args ...string) (string, error) {
+	token, err := p.tokens(ctx, repo.Namespace)
+	if err != nil {
+		return "", err
+	}
+	return p.run(ctx, dir, nil, p.environ(token), args...)
+}
+
+// run runs the git command with the input, if any, on its stdin and
+// with the environment, if any
+func (p *gitProvider) run(ctx context.Context, dir string, stdin io.Reader, env []string, args ...string) (string, error) {
+	command := args[0]
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = env
+	cmd.Stdin = stdin
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// environ returns the environment of the git commands, which sets the
+// authorization header of the requests to the host when there is a
+// token. Unlike the arguments, the environment cannot be read by the
+// other users of the machine.
+func (p *gitProvider) environ(token string) []string {
+	if token == "" {
+		return nil
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+	return append(os.Environ(),
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http."+p.host+".extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+credentials,
+	)
+}
@@ -0,0 +1,60 @@
+package paths
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/drone/drone-go/drone"
+)
+
+// NewGiteaProvider returns a provider that queries the Gitea api at
+// the endpoint, e.g. https://try.gitea.io
+func NewGiteaProvider(endpoint, token string) ChangedFilesProvider {
+	value := ""
+	if token != "" {
+		value = "token " + token
+	}
+	return &giteaProvider{
+		api: newAPIClient(endpoint, "Authorization", value),
+	}
+}
+
+type giteaProvider struct {
+	api *apiClient
+}
+
+type giteaCommit struct {
+	Files []struct {
+		Filename string `json:"filename"`
+		Status   string `json:"status"`
+	} `json:"files"`
+}
+
+func (p *giteaProvider) ChangedFiles(ctx context.Context, repo drone.Repo, build drone.Build) ([]File, error) {
+	base := "/api/v1/repos/" + url.PathEscape(repo.Namespace) + "/" + url.PathEscape(repo.Name)
+	commits := []giteaCommit{}
+	if isZeroCommit(build.Before) {
+		commit := giteaCommit{}
+		if _, err := p.api.get(ctx, base+"/git/commits/"+url.PathEscape(build.After), nil, &commit); err != nil {
+			return nil, err
+		}
+		commits = append(commits, commit)
+	} else {
+		// the comparison lists the files of each commit in the range
+		comparison := struct {
+			Commits []giteaCommit `json:"commits"`
+		}{}
+		if _, err := p.api.get(ctx, base+"/compare/"+url.PathEscape(build.Before)+"..."+url.PathEscape(build.After), nil, &comparison); err != nil {
+			return nil, err
+		}
+		commits = comparison.Commits
+	}
+
+	files := &fileSet{}
+	for _, commit := range commits {
+		for _, file := range commit.Files {
+			files.add(newFile(file.Filename, "", file.Status))
+		}
+	}
+	return files.files, nil
+}
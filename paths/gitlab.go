@@ -0,0 +1,79 @@
+package paths
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"github.com/drone/drone-go/drone"
+)
+
+// NewGitlabProvider returns a provider that queries the GitLab api at
+// the endpoint, e.g. https://gitlab.com
+func NewGitlabProvider(endpoint, token string) ChangedFilesProvider {
+	return &gitlabProvider{
+		api: newAPIClient(endpoint, "PRIVATE-TOKEN", token),
+	}
+}
+
+type gitlabProvider struct {
+	api *apiClient
+}
+
+type gitlabDiff struct {
+	OldPath     string `json:"old_path"`
+	NewPath     string `json:"new_path"`
+	NewFile     bool   `json:"new_file"`
+	RenamedFile bool   `json:"renamed_file"`
+	DeletedFile bool   `json:"deleted_file"`
+}
+
+func (d gitlabDiff) file() File {
+	switch {
+	case d.NewFile:
+		return newFile(d.NewPath, "", StatusAdded)
+	case d.DeletedFile:
+		return newFile(d.NewPath, "", StatusRemoved)
+	case d.RenamedFile:
+		return newFile(d.NewPath, d.OldPath, StatusRenamed)
+	}
+	return newFile(d.NewPath, "", StatusModified)
+}
+
+func (p *gitlabProvider) ChangedFiles(ctx context.Context, repo drone.Repo, build drone.Build) ([]File, error) {
+	project := "/api/v4/projects/" + url.PathEscape(repo.Namespace+"/"+repo.Name)
+	files := &fileSet{}
+	if isZeroCommit(build.Before) {
+		// the diff of a single commit is paginated
+		page := "1"
+		for page != "" {
+			diffs := []gitlabDiff{}
+			header, err := p.api.get(ctx, project+"/repository/commits/"+url.PathEscape(build.After)+"/diff", url.Values{
+				"page":     {page},
+				"per_page": {strconv.Itoa(100)},
+			}, &diffs)
+			if err != nil {
+				return nil, err
+			}
+			for _, diff := range diffs {
+				files.add(diff.file())
+			}
+			page = header.Get("X-Next-Page")
+		}
+		return files.files, nil
+	}
+
+	comparison := struct {
+		Diffs []gitlabDiff `json:"diffs"`
+	}{}
+	if _, err := p.api.get(ctx, project+"/repository/compare", url.Values{
+		"from": {build.Before},
+		"to":   {build.After},
+	}, &comparison); err != nil {
+		return nil, err
+	}
+	for _, diff := range comparison.Diffs {
+		files.add(diff.file())
+	}
+	return files.files, nil
+}
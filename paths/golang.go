@@ -0,0 +1,197 @@
+package paths
+
+import (
+	"context"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+)
+
+// GoSourceReader reads the go.mod and go files of a repository at the
+// commit of a build, keyed by their path in the repository
+type GoSourceReader interface {
+	GoSources(ctx context.Context, repo drone.Repo, build drone.Build) (map[string][]byte, error)
+}
+
+// isGoSource returns whether the file is needed to build the import
+// graph, vendored and test data packages are left out
+func isGoSource(name string) bool {
+	for _, segment := range strings.Split(path.Dir(name), "/") {
+		if segment == "vendor" || segment == "testdata" {
+			return false
+		}
+	}
+	return path.Base(name) == "go.mod" || strings.HasSuffix(name, ".go")
+}
+
+// goGraph is the import graph of the packages of the go modules of a
+// repository, packages are identified by their directory
+type goGraph struct {
+	// modules maps the directory of each module to its module path
+	modules map[string]string
+	// imports maps each package to the import paths it imports
+	imports map[string][]string
+	// packages maps import paths to packages
+	packages map[string]string
+}
+
+func newGoGraph(sources map[string][]byte) *goGraph {
+	g := &goGraph{
+		modules:  map[string]string{},
+		imports:  map[string][]string{},
+		packages: map[string]string{},
+	}
+	for name, data := range sources {
+		if path.Base(name) == "go.mod" {
+			if module := modulePath(data); module != "" {
+				g.modules[path.Dir(name)] = module
+			}
+		}
+	}
+	fset := token.NewFileSet()
+	for name, data := range sources {
+		if !strings.HasSuffix(name, ".go") {
+			continue
+		}
+		dir := path.Dir(name)
+		if _, ok := g.imports[dir]; !ok {
+			g.imports[dir] = []string{}
+			if importPath := g.importPath(dir); importPath != "" {
+				g.packages[importPath] = dir
+			}
+		}
+		// build constraints are ignored, so the graph holds the imports
+		// of every platform
+		file, err := parser.ParseFile(fset, name, data, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, spec := range file.Imports {
+			if value, err := strconv.Unquote(spec.Path.Value); err == nil {
+				g.imports[dir] = append(g.imports[dir], value)
+			}
+		}
+	}
+	return g
+}
+
+// modulePath returns the path in the module directive of a go.mod
+func modulePath(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], `"`)
+		}
+	}
+	return ""
+}
+
+// module returns the directory of the module holding the directory
+func (g *goGraph) module(dir string) (string, bool) {
+	root, found := "", false
+	for moduleDir := range g.modules {
+		if within(moduleDir, dir) && (!found || len(moduleDir) > len(root)) {
+			root, found = moduleDir, true
+		}
+	}
+	return root, found
+}
+
+// importPath returns the import path of the package in the directory
+func (g *goGraph) importPath(dir string) string {
+	root, ok := g.module(dir)
+	if !ok {
+		return ""
+	}
+	if dir == root {
+		return g.modules[root]
+	}
+	if root == "." {
+		return g.modules[root] + "/" + dir
+	}
+	return g.modules[root] + "/" + strings.TrimPrefix(dir, root+"/")
+}
+
+// dependencies returns the packages matching the patterns, like
+// ./cmd/api or ./cmd/..., and every package of the repository they
+// import directly or indirectly
+func (g *goGraph) dependencies(patterns []string) ([]string, error) {
+	seen := map[string]bool{}
+	queue := []string{}
+	for _, pattern := range patterns {
+		matched := false
+		for dir := range g.imports {
+			if matchPackage(pattern, dir) {
+				matched = true
+				if !seen[dir] {
+					seen[dir] = true
+					queue = append(queue, dir)
+				}
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no go packages match %q", pattern)
+		}
+	}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		for _, importPath := range g.imports[dir] {
+			if dependency, ok := g.packages[importPath]; ok && !seen[dependency] {
+				seen[dependency] = true
+				queue = append(queue, dependency)
+			}
+		}
+	}
+	dirs := []string{}
+	for dir := range seen {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// patterns returns the path patterns matching the files of the
+// packages the patterns depend on, and the go.mod and go.sum files of
+// their modules
+func (g *goGraph) patterns(packages []string) ([]string, error) {
+	dirs, err := g.dependencies(packages)
+	if err != nil {
+		return nil, err
+	}
+	patterns := []string{}
+	modules := map[string]bool{}
+	for _, dir := range dirs {
+		patterns = append(patterns, path.Join(dir, "*"))
+		if root, ok := g.module(dir); ok && !modules[root] {
+			modules[root] = true
+			patterns = append(patterns, path.Join(root, "go.mod"), path.Join(root, "go.sum"))
+		}
+	}
+	return patterns, nil
+}
+
+// matchPackage returns whether the package directory matches the
+// pattern, a relative directory optionally ending with /...
+func matchPackage(pattern, dir string) bool {
+	pattern = path.Clean(strings.TrimPrefix(pattern, "./"))
+	if pattern == "..." {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/...") {
+		return within(strings.TrimSuffix(pattern, "/..."), dir)
+	}
+	return pattern == dir
+}
+
+// within returns whether the directory is root or one of its
+// subdirectories, "." being the root of the repository
+func within(root, dir string) bool {
+	return root == "." || dir == root || strings.HasPrefix(dir, root+"/")
+}
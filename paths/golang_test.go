@@ -0,0 +1,117 @@
+package paths
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+	"github.com/stretchr/testify/require"
+)
+
+// commitSources writes the files with their contents and returns the
+// sha of the commit
+func (r *testRepository) commitSources(files map[string]string) string {
+	for file, content := range files {
+		path := filepath.Join(r.dir, file)
+		require.NoError(r.t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(r.t, ioutil.WriteFile(path, []byte(content), 0644))
+		r.git("add", file)
+	}
+	r.git("commit", "-q", "-m", "sources")
+	return r.git("rev-parse", "HEAD")
+}
+
+var goSources = map[string]string{
+	"go.mod":                    "module example.com/mono\n\ngo 1.13\n",
+	"cmd/api/main.go":           "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/mono/internal/store\"\n)\n",
+	"cmd/web/main.go":           "package main\n\nimport \"example.com/mono/internal/templates\"\n",
+	"internal/store/store.go":   "package store\n\nimport \"example.com/mono/internal/shared\"\n",
+	"internal/shared/shared.go": "package shared\n",
+	"internal/templates/t.go":   "package templates\n",
+	"tools/go.mod":              "module example.com/mono/tools\n",
+	"tools/lint/main.go":        "package main\n\nimport \"example.com/mono/internal/shared\"\n",
+	"vendor/x/x.go":             "package x\n",
+	"README.md":                 "mono\n",
+}
+
+func TestGoGraph(t *testing.T) {
+	r := newTestRepository(t)
+	defer os.RemoveAll(r.dir)
+	sha := r.commitSources(goSources)
+
+	sources, err := NewGitRepository(r.dir).(GoSourceReader).GoSources(noContext, drone.Repo{}, drone.Build{After: sha})
+	require.NoError(t, err)
+	require.Len(t, sources, 8)
+	require.Equal(t, goSources["cmd/web/main.go"], string(sources["cmd/web/main.go"]))
+
+	graph := newGoGraph(sources)
+	patterns, err := graph.patterns([]string{"./cmd/api"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"cmd/api/*", "go.mod", "go.sum", "internal/shared/*", "internal/store/*"}, patterns)
+
+	// the tools module imports the shared package from the root module
+	patterns, err = graph.patterns([]string{"./tools/..."})
+	require.NoError(t, err)
+	require.Equal(t, []string{"internal/shared/*", "go.mod", "go.sum", "tools/lint/*", "tools/go.mod", "tools/go.sum"}, patterns)
+
+	_, err = graph.patterns([]string{"./cmd/missing/..."})
+	require.EqualError(t, err, `no go packages match "./cmd/missing/..."`)
+}
+
+func TestPluginGoPackages(t *testing.T) {
+	r := newTestRepository(t)
+	defer os.RemoveAll(r.dir)
+	before := r.commitSources(goSources)
+	after := r.commitSources(map[string]string{
+		"internal/shared/shared.go": "package shared\n\nconst Name = \"shared\"\n",
+	})
+
+	config := `kind: pipeline
+name: api
+trigger:
+  go_packages:
+    - ./cmd/api/...
+---
+kind: pipeline
+name: web
+trigger:
+  go_packages:
+    - ./cmd/web/...
+`
+	provider := NewGitRepository(r.dir)
+	plugin := New(provider, WithGoSources(provider.(GoSourceReader)))
+	result, err := plugin.Convert(noContext, &converter.Request{
+		Build:  drone.Build{Before: before, After: after},
+		Config: drone.Config{Data: config},
+	})
+	require.NoError(t, err)
+	require.Equal(t, `kind: pipeline
+name: api
+trigger:
+  go_packages:
+    - ./cmd/api/...
+---
+kind: pipeline
+name: web
+trigger:
+  go_packages:
+    - ./cmd/web/...
+  x-infrastructure:
+    paths:
+      event: null
+  event:
+    exclude:
+      - '*'
+`, result.Data)
+
+	// without the sources every pipeline runs
+	result, err = New(provider).Convert(noContext, &converter.Request{
+		Build:  drone.Build{Before: before, After: after},
+		Config: drone.Config{Data: config},
+	})
+	require.NoError(t, err)
+	require.Equal(t, config, result.Data)
+}
@@ -0,0 +1,121 @@
+package paths
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/drone/drone-go/drone"
+)
+
+// EventPolicy determines how path conditions apply to the builds of
+// events that are not about a set of changes, like cron and promote
+type EventPolicy int
+
+const (
+	// EventRunAll runs every pipeline and step
+	EventRunAll EventPolicy = iota
+	// EventLastSuccess compares each pipeline with the commit of the
+	// last build in which it succeeded
+	EventLastSuccess
+)
+
+// ParseEventPolicy parses an event policy name
+func ParseEventPolicy(s string) (EventPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "run", "always":
+		return EventRunAll, nil
+	case "last-success", "lastsuccess":
+		return EventLastSuccess, nil
+	}
+	return EventRunAll, fmt.Errorf("unknown event policy %q", s)
+}
+
+// BuildHistory looks up the earlier builds of a repository
+type BuildHistory interface {
+	// LastSuccess returns, for each of the pipelines that succeeded in
+	// an earlier build comparable to the build, the commit of the last
+	// such build
+	LastSuccess(ctx context.Context, repo drone.Repo, build drone.Build, pipelines []string) (map[string]string, error)
+}
+
+// historyDepth is the number of earlier builds searched by default
+const historyDepth = 50
+
+// NewDroneHistory returns a history that queries the Drone API,
+// searching the last depth builds
+func NewDroneHistory(client drone.Client, depth int) BuildHistory {
+	if depth <= 0 {
+		depth = historyDepth
+	}
+	return &droneHistory{
+		client: client,
+		depth:  depth,
+	}
+}
+
+type droneHistory struct {
+	client drone.Client
+	depth  int
+}
+
+func (h *droneHistory) LastSuccess(ctx context.Context, repo drone.Repo, build drone.Build, pipelines []string) (map[string]string, error) {
+	commits := map[string]string{}
+	pending := map[string]bool{}
+	for _, name := range pipelines {
+		pending[name] = true
+	}
+	for page, searched := 1, 0; searched < h.depth && len(pending) > 0; page++ {
+		builds, err := h.client.BuildList(repo.Namespace, repo.Name, drone.ListOptions{Page: page, Size: h.depth})
+		if err != nil {
+			return nil, err
+		}
+		if len(builds) == 0 {
+			break
+		}
+		for _, candidate := range builds {
+			if searched == h.depth || len(pending) == 0 {
+				break
+			}
+			searched++
+			if !comparable(build, *candidate) {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			// the list of builds leaves out the stages
+			detail, err := h.client.Build(repo.Namespace, repo.Name, int(candidate.Number))
+			if err != nil {
+				return nil, err
+			}
+			for _, stage := range detail.Stages {
+				if pending[stage.Name] && stage.Status == drone.StatusPassing {
+					commits[stage.Name] = detail.After
+					delete(pending, stage.Name)
+				}
+			}
+		}
+	}
+	return commits, nil
+}
+
+// comparable returns whether the earlier build finished and ran
+// against the same branch, or deployed to the same environment, as
+// the build
+func comparable(build, earlier drone.Build) bool {
+	if build.Number != 0 && earlier.Number >= build.Number {
+		return false
+	}
+	if earlier.Status != drone.StatusPassing && earlier.Status != drone.StatusFailing {
+		return false
+	}
+	if earlier.Event == drone.EventPullRequest || earlier.Target != build.Target || earlier.After == "" {
+		return false
+	}
+	switch build.Event {
+	case drone.EventPromote, drone.EventRollback:
+		return earlier.Deploy == build.Deploy
+	}
+	return true
+}
@@ -0,0 +1,243 @@
+package paths
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andrewstucki/drone-infrastructure-plugin/chain"
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+	"github.com/stretchr/testify/require"
+)
+
+// droneClient is a Drone API stand-in serving a list of builds
+type droneClient struct {
+	drone.Client
+	builds []*drone.Build
+	// details counts the builds fetched one by one
+	details int
+}
+
+func (c *droneClient) BuildList(namespace, name string, opts drone.ListOptions) ([]*drone.Build, error) {
+	start := (opts.Page - 1) * opts.Size
+	if start >= len(c.builds) {
+		return nil, nil
+	}
+	end := start + opts.Size
+	if end > len(c.builds) {
+		end = len(c.builds)
+	}
+	list := []*drone.Build{}
+	for _, build := range c.builds[start:end] {
+		copied := *build
+		copied.Stages = nil
+		list = append(list, &copied)
+	}
+	return list, nil
+}
+
+func (c *droneClient) Build(namespace, name string, number int) (*drone.Build, error) {
+	c.details++
+	for _, build := range c.builds {
+		if build.Number == int64(number) {
+			return build, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func stages(statuses ...string) []*drone.Stage {
+	result := []*drone.Stage{}
+	for i := 0; i+1 < len(statuses); i += 2 {
+		result = append(result, &drone.Stage{Name: statuses[i], Status: statuses[i+1]})
+	}
+	return result
+}
+
+// newestFirst are the builds of the repository as listed by the api
+var newestFirst = []*drone.Build{
+	{Number: 6, Event: drone.EventPush, Target: "master", After: "running", Status: drone.StatusRunning, Stages: stages("backend", drone.StatusPassing)},
+	{Number: 5, Event: drone.EventPullRequest, Target: "master", After: "pull", Status: drone.StatusPassing, Stages: stages("backend", drone.StatusPassing, "frontend", drone.StatusPassing)},
+	{Number: 4, Event: drone.EventPush, Target: "master", After: "four", Status: drone.StatusFailing, Stages: stages("backend", drone.StatusFailing, "frontend", drone.StatusPassing)},
+	{Number: 3, Event: drone.EventPush, Target: "develop", After: "develop", Status: drone.StatusPassing, Stages: stages("backend", drone.StatusPassing)},
+	{Number: 2, Event: "cron", Target: "master", After: "two", Status: drone.StatusPassing, Stages: stages("backend", drone.StatusPassing, "frontend", drone.StatusPassing)},
+	{Number: 1, Event: drone.EventPush, Target: "master", After: "one", Status: drone.StatusPassing, Stages: stages("backend", drone.StatusPassing)},
+}
+
+func TestDroneHistory(t *testing.T) {
+	client := &droneClient{builds: newestFirst}
+	history := NewDroneHistory(client, 10)
+
+	build := drone.Build{Number: 7, Event: "cron", Target: "master"}
+	commits, err := history.LastSuccess(noContext, drone.Repo{}, build, []string{"backend", "frontend", "docs"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"backend": "two", "frontend": "four"}, commits)
+
+	// the search is limited to the most recent builds
+	client.details = 0
+	commits, err = NewDroneHistory(client, 3).LastSuccess(noContext, drone.Repo{}, build, []string{"backend"})
+	require.NoError(t, err)
+	require.Empty(t, commits)
+	require.Equal(t, 1, client.details)
+}
+
+// historyProvider lists the changes since each commit
+type historyProvider map[string][]string
+
+func (p historyProvider) ChangedFiles(ctx context.Context, repo drone.Repo, build drone.Build) ([]File, error) {
+	return NewStaticProvider(p[build.Before]...).ChangedFiles(ctx, repo, build)
+}
+
+func TestPluginLastSuccess(t *testing.T) {
+	config := `kind: pipeline
+name: backend
+trigger:
+  paths:
+    include:
+      - server/**
+---
+kind: pipeline
+name: frontend
+trigger:
+  paths:
+    include:
+      - client/**
+---
+kind: pipeline
+name: docs
+trigger:
+  paths:
+    include:
+      - docs/**
+`
+	provider := historyProvider{
+		// the frontend last passed in build 4, after which the client changed
+		"four": {"client/app.js", "server/main.go"},
+		// the backend last passed in build 2, and has not changed since
+		"two": {"client/app.js"},
+	}
+	req := &converter.Request{
+		Build:  drone.Build{Number: 7, Event: "cron", Target: "master", After: "seven"},
+		Config: drone.Config{Data: config},
+	}
+
+	plugin := New(provider,
+		WithEventPolicy("cron", EventLastSuccess),
+		WithBuildHistory(NewDroneHistory(&droneClient{builds: newestFirst}, 0)),
+	)
+	result, err := plugin.Convert(noContext, req)
+	require.NoError(t, err)
+	require.Equal(t, `kind: pipeline
+name: backend
+trigger:
+  paths:
+    include:
+      - server/**
+  x-infrastructure:
+    paths:
+      event: null
+  event:
+    exclude:
+      - '*'
+---
+kind: pipeline
+name: frontend
+trigger:
+  paths:
+    include:
+      - client/**
+---
+kind: pipeline
+name: docs
+trigger:
+  paths:
+    include:
+      - docs/**
+`, result.Data)
+
+	// the result depends on the build history and is not cached
+	cache, err := chain.NewResultCache(10, time.Hour, "")
+	require.NoError(t, err)
+	chained := chain.New().WithConverters([]converter.Plugin{plugin}).WithCache(cache)
+	for i := 0; i < 2; i++ {
+		_, err = chained.Convert(noContext, req)
+		require.NoError(t, err)
+	}
+	require.Equal(t, chain.CacheStats{Misses: 2}, cache.Stats())
+
+	// other events still run every pipeline
+	req.Build.Event = drone.EventPromote
+	result, err = plugin.Convert(noContext, req)
+	require.NoError(t, err)
+	require.Equal(t, config, result.Data)
+}
+
+func TestPluginLastSuccessUnchanged(t *testing.T) {
+	config := `kind: pipeline
+name: frontend
+steps:
+  - name: build
+    image: node
+  - name: lint
+    image: node
+    when:
+      paths:
+        include:
+          - client/**
+---
+kind: pipeline
+name: nightly
+trigger:
+  event:
+    - cron
+steps:
+  - name: report
+    image: alpine
+`
+	// the pipelines last passed at the commit of the build, so nothing changed
+	client := &droneClient{builds: []*drone.Build{
+		{Number: 1, Event: "cron", Target: "master", After: "seven", Status: drone.StatusPassing, Stages: stages("frontend", drone.StatusPassing, "nightly", drone.StatusPassing)},
+	}}
+	req := &converter.Request{
+		Build:  drone.Build{Number: 2, Event: "cron", Target: "master", After: "seven"},
+		Config: drone.Config{Data: config},
+	}
+
+	plugin := New(historyProvider{},
+		WithEventPolicy("cron", EventLastSuccess),
+		WithBuildHistory(NewDroneHistory(client, 0)),
+	)
+	result, err := plugin.Convert(noContext, req)
+	require.NoError(t, err)
+	// only the step filtering on paths is skipped
+	require.Equal(t, `kind: pipeline
+name: frontend
+steps:
+  - name: build
+    image: node
+  - name: lint
+    image: node
+    when:
+      paths:
+        include:
+          - client/**
+      x-infrastructure:
+        paths:
+          event: null
+      event:
+        exclude:
+          - '*'
+---
+kind: pipeline
+name: nightly
+trigger:
+  event:
+    - cron
+steps:
+  - name: report
+    image: alpine
+`, result.Data)
+	require.Equal(t, 1, client.details)
+}
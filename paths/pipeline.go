@@ -1,39 +1,289 @@
 package paths
 
+import (
+	"errors"
+
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
+	"gopkg.in/yaml.v3"
+)
+
 type pipeline struct {
-	Name    string                 `yaml:"name"`
-	Kind    string                 `yaml:"kind,omitempty"`
-	Steps   []*step                `yaml:"steps,omitempty"`
-	Trigger conditions             `yaml:"trigger,omitempty"`
-	Attrs   map[string]interface{} `yaml:",inline"`
+	Name      string
+	Steps     []*step
+	Trigger   conditions
+	DependsOn []string
+
+	// skipped is set once the trigger of the pipeline never matches
+	skipped bool
+	// remove drops skipped steps, and leaves skipped pipelines to be
+	// dropped, instead of excluding them from every build
+	remove bool
+	// decisions explain the outcome for the trigger and the steps
+	decisions []Decision
+
+	doc *document.Document
 }
 
-func (p *pipeline) matchOrExclude(changedFiles []string) bool {
-	for _, f := range changedFiles {
-		if p.Trigger.Paths.match(f) {
-			return false
+func newPipeline(doc *document.Document) (*pipeline, error) {
+	p := &pipeline{
+		Name: doc.Name(),
+		doc:  doc,
+	}
+	root := doc.Root()
+	if trigger := document.Lookup(root, "trigger"); trigger != nil {
+		if err := trigger.Decode(&p.Trigger); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.decodeDependsOn(); err != nil {
+		return nil, err
+	}
+	if steps := document.Lookup(root, "steps"); steps != nil && steps.Kind == yaml.SequenceNode {
+		for _, node := range steps.Content {
+			s, err := newStep(node)
+			if err != nil {
+				return nil, err
+			}
+			p.Steps = append(p.Steps, s)
+		}
+	}
+	if root, ok := cleanRoot(p.Trigger.Paths.Root); ok {
+		if err := p.under(root); err != nil {
+			return nil, err
 		}
 	}
-	if p.Trigger.Attrs == nil {
-		p.Trigger.Attrs = make(map[string]interface{})
+	return p, nil
+}
+
+// under makes the conditions of the pipeline and of its steps relative
+// to the root directory
+func (p *pipeline) under(root string) error {
+	conditions := []*conditions{&p.Trigger}
+	for _, s := range p.Steps {
+		conditions = append(conditions, &s.When)
 	}
-	p.Trigger.Attrs["event"] = map[string][]string{"exclude": {"*"}}
-	return true
+	for _, c := range conditions {
+		if err := c.under(root); err != nil {
+			var rootErr *rootError
+			if errors.As(err, &rootErr) {
+				rootErr.line = p.rootLine()
+			}
+			return err
+		}
+	}
+	return nil
 }
 
-func (p *pipeline) update(changedFiles []string) bool {
-	if p.Kind != "pipeline" {
-		return false
+// rootLine returns the line of the root of the trigger paths
+func (p *pipeline) rootLine() int {
+	paths := document.Lookup(document.Lookup(p.doc.Root(), "trigger"), "paths")
+	if key := document.LookupKey(paths, "root"); key != nil {
+		return key.Line
 	}
+	return p.doc.Line()
+}
 
-	updated := false
-	if p.matchOrExclude(changedFiles) {
-		updated = true
+func (p *pipeline) decodeDependsOn() error {
+	p.DependsOn = nil
+	if dependsOn := document.Lookup(p.doc.Root(), "depends_on"); dependsOn != nil {
+		return dependsOn.Decode(&p.DependsOn)
+	}
+	return nil
+}
+
+// filtersPaths returns whether the trigger or a step of the pipeline
+// has a path condition
+func (p *pipeline) filtersPaths() bool {
+	if p.Trigger.IsSet() {
+		return true
 	}
 	for _, s := range p.Steps {
-		if s.matchOrExclude(changedFiles) {
-			updated = true
+		if s.When.IsSet() {
+			return true
 		}
 	}
+	return false
+}
+
+func (p *pipeline) match(changedFiles []File) bool {
+	return p.Trigger.Paths.match(changedFiles)
+}
+
+// restore removes the exclusions added by an earlier conversion so
+// that the pipeline is evaluated against its original conditions
+func (p *pipeline) restore() bool {
+	root := p.doc.Root()
+	restored := false
+	if document.Restore(root, name) {
+		// the dependencies were decoded from the converted document
+		p.decodeDependsOn()
+		restored = true
+	}
+	if trigger := document.Lookup(root, "trigger"); trigger != nil {
+		restored = document.Restore(trigger, name) || restored
+	}
+	if steps := document.Lookup(root, "steps"); steps != nil {
+		for _, node := range steps.Content {
+			restored = document.Restore(node, name) || restored
+			if when := document.Lookup(node, "when"); when != nil {
+				restored = document.Restore(when, name) || restored
+			}
+		}
+	}
+	return restored
+}
+
+// run removes the exclusions of an earlier conversion so that the
+// pipeline and all of its steps run
+func (p *pipeline) run() {
+	if p.restore() {
+		p.doc.Touch()
+	}
+	p.decisions = []Decision{{Pipeline: p.Name, Run: true}}
+}
+
+func (p *pipeline) update(changedFiles []File) bool {
+	root := p.doc.Root()
+	updated := p.restore()
+	p.decisions = []Decision{p.Trigger.explain(p.Name, "", changedFiles)}
+	for _, s := range p.Steps {
+		if s.When.IsSet() {
+			p.decisions = append(p.decisions, s.When.explain(p.Name, s.Name, changedFiles))
+		}
+	}
+	if !p.match(changedFiles) {
+		p.skip()
+		updated = true
+	}
+	removed := map[int]bool{}
+	for i, s := range p.Steps {
+		if s.match(changedFiles) {
+			continue
+		}
+		updated = true
+		if p.remove {
+			removed[i] = true
+			continue
+		}
+		// the steps may be shared with other pipelines through an anchor,
+		// so take ownership of them before adding the exclusion
+		steps := document.Ensure(root, "steps", yaml.SequenceNode)
+		excludeAll(document.Ensure(document.Own(steps, i), "when", yaml.MappingNode))
+	}
+	if len(removed) > 0 {
+		p.removeSteps(removed)
+	}
+	if updated {
+		p.doc.Touch()
+	}
 	return updated
 }
+
+// skip excludes the pipeline from every build
+func (p *pipeline) skip() {
+	p.skipped = true
+	if p.remove {
+		return
+	}
+	excludeAll(document.Ensure(p.doc.Root(), "trigger", yaml.MappingNode))
+	p.doc.Touch()
+}
+
+// removeSteps removes the steps at the given positions, the steps
+// that depend on a removed step depend on its dependencies instead.
+// A pipeline without any steps left is skipped.
+func (p *pipeline) removeSteps(removed map[int]bool) {
+	dependencies := map[string][]string{}
+	for i := range removed {
+		dependencies[p.Steps[i].Name] = p.Steps[i].DependsOn
+	}
+	steps := document.Ensure(p.doc.Root(), "steps", yaml.SequenceNode)
+	content := []*yaml.Node{}
+	kept := []*step{}
+	for i, s := range p.Steps {
+		if removed[i] {
+			continue
+		}
+		if dependsOn, ok := replaceDependencies(s.DependsOn, dependencies); ok {
+			node := &yaml.Node{Kind: yaml.SequenceNode}
+			for _, dependency := range dependsOn {
+				node.Content = append(node.Content, document.Scalar(dependency))
+			}
+			document.Set(document.Own(steps, i), "depends_on", node)
+			s.DependsOn = dependsOn
+		}
+		content = append(content, steps.Content[i])
+		kept = append(kept, s)
+	}
+	steps.Content = content
+	p.Steps = kept
+	if len(kept) == 0 {
+		p.skip()
+	}
+}
+
+// replaceDependencies replaces the removed steps in depends_on with
+// their own dependencies, and returns false if none were removed
+func replaceDependencies(dependsOn []string, removed map[string][]string) ([]string, bool) {
+	replaced := false
+	result := []string{}
+	seen := map[string]bool{}
+	var add func(dependencies []string)
+	add = func(dependencies []string) {
+		for _, dependency := range dependencies {
+			if seen[dependency] {
+				continue
+			}
+			seen[dependency] = true
+			if inherited, ok := removed[dependency]; ok {
+				replaced = true
+				add(inherited)
+				continue
+			}
+			result = append(result, dependency)
+		}
+	}
+	add(dependsOn)
+	return result, replaced
+}
+
+// excludeAll adds an event filter to the conditions that never matches,
+// keeping the events the conditions already include or exclude. The
+// original filter is stashed so that it can be restored.
+func excludeAll(conditions *yaml.Node) {
+	document.Stash(conditions, name, "event")
+	include := &yaml.Node{Kind: yaml.SequenceNode}
+	exclude := &yaml.Node{Kind: yaml.SequenceNode}
+	switch event := document.Lookup(conditions, "event"); {
+	case event == nil:
+	case event.Kind == yaml.MappingNode:
+		if node := document.Lookup(event, "include"); node != nil {
+			include.Content = append(include.Content, events(node)...)
+		}
+		if node := document.Lookup(event, "exclude"); node != nil {
+			exclude.Content = append(exclude.Content, events(node)...)
+		}
+	default:
+		include.Content = append(include.Content, events(event)...)
+	}
+	exclude.Content = append(exclude.Content, document.Scalar("*"))
+
+	filter := &yaml.Node{Kind: yaml.MappingNode}
+	if len(include.Content) > 0 {
+		filter.Content = append(filter.Content, document.Scalar("include"), include)
+	}
+	filter.Content = append(filter.Content, document.Scalar("exclude"), exclude)
+	document.Set(conditions, "event", filter)
+}
+
+// events returns copies of the events of a scalar or sequence filter
+func events(node *yaml.Node) []*yaml.Node {
+	node = document.Copy(node)
+	for node.Kind == yaml.AliasNode {
+		node = document.Copy(node.Alias)
+	}
+	if node.Kind == yaml.SequenceNode {
+		return node.Content
+	}
+	return []*yaml.Node{node}
+}
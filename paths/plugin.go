@@ -1,15 +1,23 @@
 package paths
 
 import (
-	"bytes"
 	"context"
-	"io"
+	"errors"
 
+	"github.com/andrewstucki/drone-infrastructure-plugin/chain"
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/converter"
 	"github.com/google/go-github/v28/github"
 	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v3"
+)
+
+const name = "paths"
+
+// events that drone-go has no constant for
+const (
+	eventCron   = "cron"
+	eventCustom = "custom"
 )
 
 //go:generate mockgen -source plugin.go -package paths -destination mock_test.go
@@ -20,60 +28,208 @@ type GithubRepositoryClient interface {
 	CompareCommits(ctx context.Context, owner string, repo string, base string, head string) (*github.CommitsComparison, *github.Response, error)
 }
 
+// Option configures the conversion plugin
+type Option func(*plugin)
+
+// WithDependencyPolicy sets what happens to the pipelines that depend
+// on a skipped pipeline, dependents are skipped by default
+func WithDependencyPolicy(policy DependencyPolicy) Option {
+	return func(p *plugin) {
+		p.dependencies = policy
+	}
+}
+
+// WithRemoveSkipped removes skipped pipelines and steps from the
+// configuration instead of adding an event filter that never matches
+func WithRemoveSkipped() Option {
+	return func(p *plugin) {
+		p.remove = true
+	}
+}
+
+// WithPathSets sets the path sets available to every repository, the
+// sets defined by a configuration take precedence
+func WithPathSets(sets PathSets) Option {
+	return func(p *plugin) {
+		p.sets = sets
+	}
+}
+
+// WithGoSources sets the reader used to build the import graph of the
+// go packages named by go_packages conditions
+func WithGoSources(sources GoSourceReader) Option {
+	return func(p *plugin) {
+		p.goSources = sources
+	}
+}
+
+// WithExplain sets an environment variable on the first step of every
+// pipeline that runs explaining the decisions made for the pipeline
+func WithExplain() Option {
+	return func(p *plugin) {
+		p.explain = true
+	}
+}
+
+// WithRecorder records the decisions made for every conversion
+func WithRecorder(recorder *Recorder) Option {
+	return func(p *plugin) {
+		p.recorder = recorder
+	}
+}
+
+// WithEventPolicy sets how path conditions apply to the builds of an
+// event that is not about a set of changes, like cron, promote,
+// rollback and custom. Every pipeline runs for them by default.
+func WithEventPolicy(event string, policy EventPolicy) Option {
+	return func(p *plugin) {
+		p.events[event] = policy
+	}
+}
+
+// WithBuildHistory sets the history used to find the last successful
+// build of the pipelines for the EventLastSuccess policy
+func WithBuildHistory(history BuildHistory) Option {
+	return func(p *plugin) {
+		p.history = history
+	}
+}
+
+// WithFailOpen runs every pipeline and step when the changed files
+// cannot be listed, instead of failing the conversion. The result is
+// not cached, so the next build of the commit tries again.
+func WithFailOpen() Option {
+	return func(p *plugin) {
+		p.failOpen = true
+	}
+}
+
 // New returns a new conversion plugin.
-func New(client GithubRepositoryClient) converter.Plugin {
-	return &plugin{
-		client: client,
+func New(provider ChangedFilesProvider, options ...Option) chain.Converter {
+	p := &plugin{
+		provider: provider,
+		events:   map[string]EventPolicy{},
 	}
+	for _, option := range options {
+		option(p)
+	}
+	return p
 }
 
 type plugin struct {
-	client GithubRepositoryClient
+	provider     ChangedFilesProvider
+	dependencies DependencyPolicy
+	remove       bool
+	sets         PathSets
+	goSources    GoSourceReader
+	explain      bool
+	recorder     *Recorder
+	events       map[string]EventPolicy
+	history      BuildHistory
+	failOpen     bool
 }
 
-func getFilesChanged(ctx context.Context, repo drone.Repo, build drone.Build, client GithubRepositoryClient) ([]string, error) {
-	var commitFiles []github.CommitFile
-	if build.Before == "" || build.Before == "0000000000000000000000000000000000000000" {
-		response, _, err := client.GetCommit(ctx, repo.Namespace, repo.Name, build.After)
-		if err != nil {
-			return nil, err
+// comparison returns the build whose commits are compared to list the
+// changed files, and false for events that are not about a set of
+// changes, for which every pipeline runs
+func comparison(build drone.Build) (drone.Build, bool) {
+	switch build.Event {
+	case drone.EventPullRequest:
+		// the providers compare from the merge-base of the target
+		// branch and the pull request, so changes made to the target
+		// branch since the pull request was opened are left out
+		if build.Target != "" {
+			build.Before = build.Target
 		}
-		commitFiles = response.Files
-	} else {
-		response, _, err := client.CompareCommits(ctx, repo.Namespace, repo.Name, build.Before, build.After)
-		if err != nil {
-			return nil, err
-		}
-		commitFiles = response.Files
+		return build, true
+	case drone.EventTag, drone.EventPromote, drone.EventRollback, eventCron, eventCustom:
+		return build, false
 	}
+	return build, true
+}
 
-	var files []string
-	for _, f := range commitFiles {
-		files = append(files, *f.Filename)
+// runAll removes the exclusions of an earlier conversion so that every
+// pipeline and step runs
+func runAll(pipelines []*pipeline) {
+	for _, p := range pipelines {
+		p.run()
+	}
+}
+
+// expandGoPackages adds the files of the go packages the conditions
+// depend on to their included paths
+func (p *plugin) expandGoPackages(ctx context.Context, repo drone.Repo, build drone.Build, pipelines []*pipeline) error {
+	expand := []*conditions{}
+	for _, pipeline := range pipelines {
+		if len(pipeline.Trigger.GoPackages) > 0 {
+			expand = append(expand, &pipeline.Trigger)
+		}
+		for _, step := range pipeline.Steps {
+			if len(step.When.GoPackages) > 0 {
+				expand = append(expand, &step.When)
+			}
+		}
+	}
+	if len(expand) == 0 {
+		return nil
 	}
 
-	return files, nil
+	if p.goSources == nil {
+		// without the sources the dependencies are unknown, so run
+		// rather than skip on changes to them
+		logrus.WithField("repo_name", repo.Name).Warnln("no go sources to resolve go_packages, running on any change")
+		for _, c := range expand {
+			c.Paths.Include = append(c.Paths.Include, "**")
+		}
+		return nil
+	}
+	sources, err := p.goSources.GoSources(ctx, repo, build)
+	if err != nil {
+		return &chain.Error{
+			Kind:      chain.ErrSCM,
+			Converter: name,
+			File:      repo.Config,
+			Err:       err,
+		}
+	}
+	graph := newGoGraph(sources)
+	for _, c := range expand {
+		patterns, err := graph.patterns(c.GoPackages)
+		if err != nil {
+			return &chain.Error{
+				Kind:      chain.ErrInvalid,
+				Converter: name,
+				File:      repo.Config,
+				Err:       err,
+			}
+		}
+		c.Paths.Include = append(c.Paths.Include, patterns...)
+	}
+	return nil
 }
 
 func shouldGetFiles(pipelines []*pipeline) bool {
 	// we only need to grab the files that changed if we actually have a inclusion/exclusion trigger
 	for _, p := range pipelines {
-		if p.Kind != "pipeline" {
-			continue
-		}
-		if p.Trigger.Paths.HasIncludes() || p.Trigger.Paths.HasExcludes() {
+		if p.filtersPaths() {
 			return true
 		}
-		for _, step := range p.Steps {
-			if step.When.Paths.HasIncludes() || step.When.Paths.HasExcludes() {
-				return true
-			}
-		}
 	}
 	return false
 }
 
+// Name returns the name of the converter
+func (p *plugin) Name() string {
+	return name
+}
+
+// Convert skips pipelines and steps based on the files changed in the build
 func (p *plugin) Convert(ctx context.Context, req *converter.Request) (*drone.Config, error) {
+	return chain.Apply(ctx, req, p)
+}
+
+// ConvertConfig skips pipelines and steps in the parsed configuration
+func (p *plugin) ConvertConfig(ctx context.Context, req *converter.Request, config *document.Config) error {
 	logrus.WithFields(logrus.Fields{
 		"build_action":   req.Build.Action,
 		"build_after":    req.Build.After,
@@ -90,65 +246,209 @@ func (p *plugin) Convert(ctx context.Context, req *converter.Request) (*drone.Co
 		"repo_name":      req.Repo.Name,
 	}).Debugln("initiated path skipping convert plugin")
 
-	pipelines := []*pipeline{}
+	sets, err := p.pathSets(config)
+	if err != nil {
+		return &chain.Error{
+			Kind:      chain.ErrInvalid,
+			Converter: name,
+			File:      req.Repo.Config,
+			Err:       err,
+		}
+	}
 
-	decoder := yaml.NewDecoder(bytes.NewBuffer([]byte(req.Config.Data)))
-	for {
-		pipeline := new(pipeline)
-		err := decoder.Decode(pipeline)
-		if err == io.EOF {
-			break
+	pipelines := []*pipeline{}
+	for _, doc := range config.Pipelines() {
+		if err := sets.expandPipeline(doc); err != nil {
+			return &chain.Error{
+				Kind:      chain.ErrInvalid,
+				Converter: name,
+				File:      req.Repo.Config,
+				Line:      doc.Line(),
+				Pipeline:  doc.Name(),
+				Err:       err,
+			}
+		}
+		pipeline, err := newPipeline(doc)
+		var rootErr *rootError
+		if errors.As(err, &rootErr) {
+			return &chain.Error{
+				Kind:      chain.ErrInvalid,
+				Converter: name,
+				File:      req.Repo.Config,
+				Line:      rootErr.line,
+				Pipeline:  doc.Name(),
+				Err:       err,
+			}
 		}
 		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"build_id":       req.Build.ID,
-				"repo_namespace": req.Repo.Namespace,
-				"repo_name":      req.Repo.Name,
-			}).Errorln(err)
-			return nil, nil
+			converterErr := chain.DecodeError(name, req.Repo.Config, err)
+			converterErr.Pipeline = doc.Name()
+			return converterErr
 		}
+		pipeline.remove = p.remove
 		pipelines = append(pipelines, pipeline)
 	}
 
 	if !shouldGetFiles(pipelines) {
 		// no need to go any further since we have no inclusion/exclusion rules
-		return &req.Config, nil
+		return nil
 	}
 
-	files, err := getFilesChanged(ctx, req.Repo, req.Build, p.client)
+	logger := logrus.WithFields(logrus.Fields{
+		"build_id":       req.Build.ID,
+		"build_event":    req.Build.Event,
+		"repo_namespace": req.Repo.Namespace,
+		"repo_name":      req.Repo.Name,
+	})
+	build, ok := comparison(req.Build)
+	if !ok {
+		if p.events[req.Build.Event] != EventLastSuccess || p.history == nil {
+			logger.Debugln("running all pipelines for event")
+			runAll(pipelines)
+			return nil
+		}
+		return p.sinceLastSuccess(ctx, req, config, pipelines, logger)
+	}
+
+	files, err := p.provider.ChangedFiles(ctx, req.Repo, build)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"build_id":       req.Build.ID,
-			"repo_namespace": req.Repo.Namespace,
-			"repo_name":      req.Repo.Name,
-		}).Errorln(err)
-		return nil, nil
+		return p.changedFilesError(ctx, req, pipelines, err, logger)
+	}
+	changes := map[*pipeline][]File{}
+	for _, pipeline := range pipelines {
+		changes[pipeline] = files
 	}
+	return p.apply(ctx, req, config, pipelines, changes, logger)
+}
 
-	for _, p := range pipelines {
-		if p.update(files) {
-			logrus.WithFields(logrus.Fields{
-				"build_id":       req.Build.ID,
-				"repo_namespace": req.Repo.Namespace,
-				"repo_name":      req.Repo.Name,
-				"pipeline_name":  p.Name,
-			}).Debugln("skipping part of pipeline")
+// changedFilesError runs every pipeline when the list of changed files
+// is incomplete, or cannot be had and the plugin fails open, and returns
+// the error otherwise
+func (p *plugin) changedFilesError(ctx context.Context, req *converter.Request, pipelines []*pipeline, err error, logger logrus.FieldLogger) error {
+	if errors.Is(err, ErrIncomplete) {
+		// fail open rather than skip pipelines for files we could not see
+		logger.WithError(err).Warnln("running all pipelines")
+		runAll(pipelines)
+		return nil
+	}
+	if p.failOpen {
+		// the error may not happen again, so the result is not cached
+		logger.WithError(err).Warnln("cannot list the changed files, running all pipelines")
+		chain.Degrade(ctx)
+		runAll(pipelines)
+		return nil
+	}
+	return &chain.Error{
+		Kind:      chain.ErrSCM,
+		Converter: name,
+		File:      req.Repo.Config,
+		Err:       err,
+	}
+}
+
+// sinceLastSuccess compares each pipeline with the last build in which
+// it succeeded, the pipelines that never succeeded run. The result
+// depends on the build history and is not cached.
+func (p *plugin) sinceLastSuccess(ctx context.Context, req *converter.Request, config *document.Config, pipelines []*pipeline, logger logrus.FieldLogger) error {
+	chain.Degrade(ctx)
+	// the pipelines that do not filter on paths run as they are
+	names := []string{}
+	for _, pipeline := range pipelines {
+		if pipeline.filtersPaths() {
+			names = append(names, pipeline.Name)
 		}
 	}
+	commits, err := p.history.LastSuccess(ctx, req.Repo, req.Build, names)
+	if err != nil {
+		// fail open rather than skip pipelines without knowing when they last ran
+		logger.WithError(err).Warnln("cannot find the last successful builds, running all pipelines")
+		runAll(pipelines)
+		return nil
+	}
 
-	buffer := new(bytes.Buffer)
-	encoder := yaml.NewEncoder(buffer)
-	for _, p := range pipelines {
-		if err := encoder.Encode(p); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"build_id":       req.Build.ID,
-				"repo_namespace": req.Repo.Namespace,
-				"repo_name":      req.Repo.Name,
-			}).Errorln(err)
-			return nil, nil
-		}
-	}
-	return &drone.Config{
-		Data: buffer.String(),
-	}, nil
+	changes := map[*pipeline][]File{}
+	files := map[string][]File{}
+	for _, pipeline := range pipelines {
+		commit, ok := commits[pipeline.Name]
+		if !ok {
+			continue
+		}
+		if _, ok := files[commit]; !ok {
+			build := req.Build
+			build.Before = commit
+			changed, err := p.provider.ChangedFiles(ctx, req.Repo, build)
+			if err != nil {
+				return p.changedFilesError(ctx, req, pipelines, err, logger)
+			}
+			files[commit] = changed
+		}
+		changes[pipeline] = files[commit]
+	}
+	return p.apply(ctx, req, config, pipelines, changes, logger)
+}
+
+// apply skips the parts of the pipelines that the changed files do not
+// match, the pipelines without changes run
+func (p *plugin) apply(ctx context.Context, req *converter.Request, config *document.Config, pipelines []*pipeline, changes map[*pipeline][]File, logger logrus.FieldLogger) error {
+	if err := p.expandGoPackages(ctx, req.Repo, req.Build, pipelines); err != nil {
+		return err
+	}
+
+	for _, pipeline := range pipelines {
+		files, ok := changes[pipeline]
+		if !ok {
+			pipeline.run()
+			continue
+		}
+		if pipeline.update(files) {
+			logger.WithField("pipeline_name", pipeline.Name).Debugln("skipping part of pipeline")
+		}
+	}
+	dependents, err := resolveDependencies(pipelines, p.dependencies)
+	if err != nil {
+		converterErr := &chain.Error{
+			Kind:      chain.ErrInvalid,
+			Converter: name,
+			File:      req.Repo.Config,
+			Err:       err,
+		}
+		var dependencyErr *skippedDependencyError
+		if errors.As(err, &dependencyErr) {
+			converterErr.Pipeline = dependencyErr.pipeline
+		}
+		return converterErr
+	}
+	for _, p := range dependents {
+		logger.WithField("pipeline_name", p.Name).Debugln("updating dependencies of skipped pipelines")
+	}
+
+	decisions := []Decision{}
+	for _, pipeline := range pipelines {
+		pipeline.decisions[0].Run = !pipeline.skipped
+		decisions = append(decisions, pipeline.decisions...)
+		if !p.explain || pipeline.skipped {
+			continue
+		}
+		if err := pipeline.annotate(pipeline.decisions); err != nil {
+			return &chain.Error{
+				Kind:      chain.ErrEncode,
+				Converter: name,
+				File:      req.Repo.Config,
+				Pipeline:  pipeline.Name,
+				Err:       err,
+			}
+		}
+	}
+	if p.recorder != nil {
+		p.recorder.record(req.Repo, req.Build, decisions)
+	}
+	if p.remove {
+		for _, p := range pipelines {
+			if p.skipped {
+				logger.WithField("pipeline_name", p.Name).Debugln("removing pipeline")
+				config.Remove(p.doc)
+			}
+		}
+	}
+	return nil
 }
@@ -2,10 +2,13 @@ package paths
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"testing"
 
+	"github.com/andrewstucki/drone-infrastructure-plugin/chain"
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/converter"
 	gomock "github.com/golang/mock/gomock"
@@ -27,9 +30,9 @@ type compareCommitsResponse struct {
 
 func makeCommitFiles(paths []string) []github.CommitFile {
 	files := []github.CommitFile{}
-	for _, p := range paths {
+	for i := range paths {
 		files = append(files, github.CommitFile{
-			Filename: &p,
+			Filename: &paths[i],
 		})
 	}
 	return files
@@ -64,6 +67,12 @@ func TestPlugin(t *testing.T) {
 		{"pipeline", nil, newCompareCommitsResponse([]string{"README.md"}, nil)},
 		{"steps", newGetCommitResponse([]string{"README.md"}, nil), nil},
 		{"steps", nil, newCompareCommitsResponse([]string{"README.md"}, nil)},
+		{"anchors", nil, newCompareCommitsResponse([]string{"README.md"}, nil)},
+		{"ignore", nil, newCompareCommitsResponse([]string{"README.md", "yarn.lock"}, nil)},
+		{"expressions", nil, newCompareCommitsResponse([]string{"services/api/main.go", "services/api/README.md", "docs/index.md"}, nil)},
+		{"skipped", nil, newCompareCommitsResponse([]string{"README.md"}, nil)},
+		{"sets", nil, newCompareCommitsResponse([]string{"server/main.go", "README.md"}, nil)},
+		{"root", nil, newCompareCommitsResponse([]string{"services/api/main.go", "services/web/README.md", "docs/index.md"}, nil)},
 	}
 	for _, test := range tests {
 		t.Run(test.file, func(t *testing.T) {
@@ -98,19 +107,351 @@ func TestPlugin(t *testing.T) {
 			if test.commitResponse != nil {
 				client.EXPECT().
 					GetCommit(noContext, repo.Namespace, repo.Name, build.After).
-					Return(test.commitResponse.commit, nil, test.commitResponse.err)
+					Return(test.commitResponse.commit, nil, test.commitResponse.err).
+					Times(2)
 			}
 			if test.diffResponse != nil {
 				client.EXPECT().
 					CompareCommits(noContext, repo.Namespace, repo.Name, build.Before, build.After).
-					Return(test.diffResponse.diff, nil, test.diffResponse.err)
+					Return(test.diffResponse.diff, nil, test.diffResponse.err).
+					Times(2)
 			}
-			plugin := New(client)
+			plugin := New(NewGithubProvider(client))
 
 			config, err := plugin.Convert(noContext, req)
 			require.NoError(t, err)
 			require.NotNil(t, config)
 			require.Equal(t, string(after), config.Data)
+
+			// converting the output again must leave it unchanged
+			req.Config.Data = config.Data
+			config, err = plugin.Convert(noContext, req)
+			require.NoError(t, err)
+			require.NotNil(t, config)
+			require.Equal(t, string(after), config.Data)
+		})
+	}
+}
+
+func TestPluginSCMError(t *testing.T) {
+	before, err := ioutil.ReadFile("testdata/pipeline.yml")
+	require.NoError(t, err)
+
+	build := drone.Build{
+		After: "3d21ec53a331a6f037a91c368710b99387d012c1",
+	}
+	repo := drone.Repo{
+		Slug:   "octocat/hello-world",
+		Config: ".drone.yml",
+	}
+	req := &converter.Request{
+		Build: build,
+		Repo:  repo,
+		Config: drone.Config{
+			Data: string(before),
+		},
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockGithubRepositoryClient(ctrl)
+	client.EXPECT().
+		GetCommit(noContext, repo.Namespace, repo.Name, build.After).
+		Return(nil, nil, errors.New("bad credentials"))
+
+	config, err := New(NewGithubProvider(client)).Convert(noContext, req)
+	require.Nil(t, config)
+	require.EqualError(t, err, "paths: .drone.yml: cannot query source control: bad credentials")
+
+	var converterErr *chain.Error
+	require.True(t, errors.As(err, &converterErr))
+	require.Equal(t, chain.ErrSCM, converterErr.Kind)
+}
+
+func TestPluginRootEscape(t *testing.T) {
+	req := &converter.Request{
+		Repo: drone.Repo{Config: ".drone.yml"},
+		Config: drone.Config{
+			Data: `kind: pipeline
+name: api
+
+trigger:
+  paths:
+    root: services/api
+
+steps:
+- name: migrate
+  image: migrate/migrate
+  when:
+    paths:
+      include:
+      - ../shared/**
+`,
+		},
+	}
+
+	// the configuration is rejected before any changed files are listed
+	config, err := New(NewGithubProvider(nil)).Convert(noContext, req)
+	require.Nil(t, config)
+	require.EqualError(t, err, `paths: .drone.yml:6: pipeline "api": invalid configuration: pattern "../shared/**" leaves the root services/api`)
+
+	var converterErr *chain.Error
+	require.True(t, errors.As(err, &converterErr))
+	require.Equal(t, chain.ErrInvalid, converterErr.Kind)
+}
+
+func TestPluginRestore(t *testing.T) {
+	after, err := ioutil.ReadFile("testdata/pipeline.yml.golden")
+	require.NoError(t, err)
+
+	build := drone.Build{
+		After: "3d21ec53a331a6f037a91c368710b99387d012c1",
+	}
+	req := &converter.Request{
+		Build: build,
+		Repo: drone.Repo{
+			Slug:   "octocat/hello-world",
+			Config: ".drone.yml",
+		},
+		Config: drone.Config{
+			Data: string(after),
+		},
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockGithubRepositoryClient(ctrl)
+	client.EXPECT().
+		GetCommit(noContext, req.Repo.Namespace, req.Repo.Name, build.After).
+		Return(newGetCommitResponse([]string{"no-match.md"}, nil).commit, nil, nil)
+
+	config, err := New(NewGithubProvider(client)).Convert(noContext, req)
+	require.NoError(t, err)
+	require.NotNil(t, config)
+
+	// the pipelines skipped by the earlier conversion get their events back
+	converted, err := document.Parse(config.Data)
+	require.NoError(t, err)
+	events := map[string]interface{}{}
+	for _, doc := range converted.Pipelines() {
+		trigger := document.Lookup(doc.Root(), "trigger")
+		var event interface{}
+		if node := document.Lookup(trigger, "event"); node != nil {
+			require.NoError(t, node.Decode(&event))
+		}
+		events[doc.Name()] = event
+	}
+	require.Equal(t, map[string]interface{}{
+		"include": map[string]interface{}{"exclude": []interface{}{"*"}},
+		"exclude": []interface{}{"push", "tag"},
+		"exclude-include": map[string]interface{}{
+			"include": []interface{}{"push", "tag"},
+			"exclude": []interface{}{"*"},
+		},
+		"exclude-no-match": map[string]interface{}{"exclude": []interface{}{"*"}},
+		"include-no-match": nil,
+	}, events)
+}
+
+func TestPluginEvents(t *testing.T) {
+	tests := []struct {
+		event  string
+		action string
+		base   string
+	}{
+		{drone.EventPush, "", "1"},
+		{drone.EventPullRequest, "opened", "master"},
+		{drone.EventPullRequest, "synchronized", "master"},
+		{drone.EventPullRequest, "reopened", "master"},
+		{drone.EventTag, "", ""},
+		{drone.EventPromote, "", ""},
+		{drone.EventRollback, "", ""},
+		{"cron", "", ""},
+		{"custom", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.event+" "+test.action, func(t *testing.T) {
+			before, err := ioutil.ReadFile("testdata/pipeline.yml")
+			require.NoError(t, err)
+			after, err := ioutil.ReadFile("testdata/pipeline.yml.golden")
+			require.NoError(t, err)
+
+			build := drone.Build{
+				Event:  test.event,
+				Action: test.action,
+				Before: "1",
+				After:  "3d21ec53a331a6f037a91c368710b99387d012c1",
+				Target: "master",
+			}
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := NewMockGithubRepositoryClient(ctrl)
+			if test.base != "" {
+				client.EXPECT().
+					CompareCommits(noContext, "", "", test.base, build.After).
+					Return(newCompareCommitsResponse([]string{"README.md"}, nil).diff, nil, nil)
+			}
+
+			config, err := New(NewGithubProvider(client)).Convert(noContext, &converter.Request{
+				Build:  build,
+				Repo:   drone.Repo{Config: ".drone.yml"},
+				Config: drone.Config{Data: string(before)},
+			})
+			require.NoError(t, err)
+			if test.base == "" {
+				// every pipeline runs
+				require.Equal(t, string(before), config.Data)
+			} else {
+				require.Equal(t, string(after), config.Data)
+			}
+		})
+	}
+}
+
+func TestPluginStatus(t *testing.T) {
+	before, err := ioutil.ReadFile("testdata/status.yml")
+	require.NoError(t, err)
+	after, err := ioutil.ReadFile("testdata/status.yml.golden")
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockGithubRepositoryClient(ctrl)
+	client.EXPECT().
+		CompareCommits(noContext, "", "", "1", "2").
+		Return(&github.CommitsComparison{
+			Files: []github.CommitFile{
+				{
+					Filename:         github.String("shared/app.js"),
+					PreviousFilename: github.String("client/app.js"),
+					Status:           github.String("renamed"),
+				},
+				{
+					Filename: github.String("docs/index.md"),
+					Status:   github.String("modified"),
+				},
+			},
+		}, nil, nil)
+
+	config, err := New(NewGithubProvider(client)).Convert(noContext, &converter.Request{
+		Build:  drone.Build{Before: "1", After: "2"},
+		Repo:   drone.Repo{Config: ".drone.yml"},
+		Config: drone.Config{Data: string(before)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, string(after), config.Data)
+}
+
+func TestPluginDependencies(t *testing.T) {
+	tests := []struct {
+		policy string
+		err    string
+	}{
+		{"cascade", ""},
+		{"drop-edge", ""},
+		{"fail", `paths: .drone.yml: pipeline "deploy": invalid configuration: depends on skipped pipelines: frontend`},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			before, err := ioutil.ReadFile("testdata/depends.yml")
+			require.NoError(t, err)
+
+			policy, err := ParseDependencyPolicy(test.policy)
+			require.NoError(t, err)
+			plugin := New(NewStaticProvider("server/main.go"), WithDependencyPolicy(policy))
+			req := &converter.Request{
+				Build:  drone.Build{Before: "1", After: "2"},
+				Repo:   drone.Repo{Config: ".drone.yml"},
+				Config: drone.Config{Data: string(before)},
+			}
+
+			config, err := plugin.Convert(noContext, req)
+			if test.err != "" {
+				require.Nil(t, config)
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			afterFile := fmt.Sprintf("testdata/depends.%s.yml.golden", test.policy)
+			after, err := ioutil.ReadFile(afterFile)
+			require.NoError(t, err)
+			require.Equal(t, string(after), config.Data)
+
+			// converting the output again must leave it unchanged
+			req.Config.Data = config.Data
+			config, err = plugin.Convert(noContext, req)
+			require.NoError(t, err)
+			require.Equal(t, string(after), config.Data)
+		})
+	}
+}
+
+func TestPluginRemoveSkipped(t *testing.T) {
+	before, err := ioutil.ReadFile("testdata/skipped.yml")
+	require.NoError(t, err)
+	after, err := ioutil.ReadFile("testdata/skipped.remove.yml.golden")
+	require.NoError(t, err)
+
+	plugin := New(NewStaticProvider("README.md"), WithRemoveSkipped())
+	req := &converter.Request{
+		Build:  drone.Build{Before: "1", After: "2"},
+		Repo:   drone.Repo{Config: ".drone.yml"},
+		Config: drone.Config{Data: string(before)},
+	}
+
+	config, err := plugin.Convert(noContext, req)
+	require.NoError(t, err)
+	require.Equal(t, string(after), config.Data)
+
+	// converting the output again must leave it unchanged
+	req.Config.Data = config.Data
+	config, err = plugin.Convert(noContext, req)
+	require.NoError(t, err)
+	require.Equal(t, string(after), config.Data)
+}
+
+func TestPluginPathSets(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		result string
+		err    string
+	}{
+		{
+			name:   "plugin",
+			config: "kind: pipeline\nname: docs\ntrigger:\n  paths:\n    include:\n      - \"@docs\"\n",
+			result: "kind: pipeline\nname: docs\ntrigger:\n  paths:\n    include:\n      - docs/**\n",
+		},
+		{
+			name:   "override",
+			config: "kind: paths\ndocs:\n  - \"*/index.md\"\n---\nkind: pipeline\nname: docs\ntrigger:\n  paths:\n    include:\n      - \"@docs\"\n",
+			result: "---\nkind: pipeline\nname: docs\ntrigger:\n  paths:\n    include:\n      - '*/index.md'\n",
+		},
+		{
+			name:   "unknown",
+			config: "kind: pipeline\nname: api\ntrigger:\n  paths:\n    include:\n      - \"@api\"\n",
+			err:    `paths: .drone.yml:1: pipeline "api": invalid configuration: unknown path set "api"`,
+		},
+		{
+			name:   "cycle",
+			config: "kind: paths\na:\n  - \"@b\"\nb:\n  - \"@a\"\n---\nkind: pipeline\nname: api\ntrigger:\n  paths:\n    include:\n      - \"@a\"\n",
+			err:    `paths: .drone.yml:7: pipeline "api": invalid configuration: path set "a" refers to itself`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plugin := New(NewStaticProvider("docs/index.md"), WithPathSets(PathSets{"docs": {"docs/**"}}))
+			config, err := plugin.Convert(noContext, &converter.Request{
+				Build:  drone.Build{Before: "1", After: "2"},
+				Repo:   drone.Repo{Config: ".drone.yml"},
+				Config: drone.Config{Data: test.config},
+			})
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.result, config.Data)
 		})
 	}
 }
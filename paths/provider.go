@@ -0,0 +1,103 @@
+package paths
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/google/go-github/v28/github"
+)
+
+// githubFileLimit is the number of files after which GitHub truncates
+// the files of a commit or a comparison
+const githubFileLimit = 300
+
+// ErrIncomplete is returned by providers that cannot list all of the
+// changed files, every pipeline and step is run in that case
+var ErrIncomplete = errors.New("the list of changed files is incomplete")
+
+// ChangedFilesProvider lists the files changed by a build
+type ChangedFilesProvider interface {
+	ChangedFiles(ctx context.Context, repo drone.Repo, build drone.Build) ([]File, error)
+}
+
+// NewGithubProvider returns a provider that queries the GitHub API
+func NewGithubProvider(client GithubRepositoryClient) ChangedFilesProvider {
+	return &githubProvider{client: client}
+}
+
+type githubProvider struct {
+	client GithubRepositoryClient
+}
+
+func (p *githubProvider) ChangedFiles(ctx context.Context, repo drone.Repo, build drone.Build) ([]File, error) {
+	if isZeroCommit(build.Before) {
+		return p.commitFiles(ctx, repo, build.After)
+	}
+
+	comparison, _, err := p.client.CompareCommits(ctx, repo.Namespace, repo.Name, build.Before, build.After)
+	if err != nil {
+		return nil, err
+	}
+	if len(comparison.Files) < githubFileLimit {
+		return filenames(comparison.Files), nil
+	}
+
+	// the comparison is truncated, so list the files of each commit
+	// instead, as long as the comparison lists all of the commits
+	if comparison.GetTotalCommits() > len(comparison.Commits) {
+		return nil, fmt.Errorf("%w: the comparison lists %d of %d commits", ErrIncomplete, len(comparison.Commits), comparison.GetTotalCommits())
+	}
+	files := &fileSet{}
+	for _, commit := range comparison.Commits {
+		commitFiles, err := p.commitFiles(ctx, repo, commit.GetSHA())
+		if err != nil {
+			return nil, err
+		}
+		files.add(commitFiles...)
+	}
+	return files.files, nil
+}
+
+// commitFiles lists the files changed by a single commit
+func (p *githubProvider) commitFiles(ctx context.Context, repo drone.Repo, sha string) ([]File, error) {
+	commit, _, err := p.client.GetCommit(ctx, repo.Namespace, repo.Name, sha)
+	if err != nil {
+		return nil, err
+	}
+	if len(commit.Files) >= githubFileLimit {
+		return nil, fmt.Errorf("%w: commit %s changes at least %d files", ErrIncomplete, sha, githubFileLimit)
+	}
+	return filenames(commit.Files), nil
+}
+
+func filenames(commitFiles []github.CommitFile) []File {
+	var files []File
+	for _, f := range commitFiles {
+		files = append(files, newFile(f.GetFilename(), f.GetPreviousFilename(), f.GetStatus()))
+	}
+	return files
+}
+
+// NewStaticProvider returns a provider that always lists the same
+// files, as modified
+func NewStaticProvider(names ...string) ChangedFilesProvider {
+	files := staticProvider{}
+	for _, name := range names {
+		files = append(files, newFile(name, "", StatusModified))
+	}
+	return files
+}
+
+type staticProvider []File
+
+func (p staticProvider) ChangedFiles(ctx context.Context, repo drone.Repo, build drone.Build) ([]File, error) {
+	return p, nil
+}
+
+// isZeroCommit returns whether the build has no previous commit, as
+// for the first push of a branch
+func isZeroCommit(sha string) bool {
+	return sha == "" || sha == "0000000000000000000000000000000000000000"
+}
@@ -0,0 +1,138 @@
+package paths
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+	gomock "github.com/golang/mock/gomock"
+	github "github.com/google/go-github/v28/github"
+	"github.com/stretchr/testify/require"
+)
+
+func manyFiles(prefix string, count int) []string {
+	files := []string{}
+	for i := 0; i < count; i++ {
+		files = append(files, fmt.Sprintf("%s/%d.go", prefix, i))
+	}
+	return files
+}
+
+func makeCommits(shas ...string) []github.RepositoryCommit {
+	commits := []github.RepositoryCommit{}
+	for i := range shas {
+		commits = append(commits, github.RepositoryCommit{SHA: &shas[i]})
+	}
+	return commits
+}
+
+func TestGithubProviderTruncated(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockGithubRepositoryClient(ctrl)
+
+	diff := newCompareCommitsResponse(manyFiles("vendor", githubFileLimit), nil).diff
+	diff.TotalCommits = github.Int(2)
+	diff.Commits = makeCommits("c1", "c2")
+	client.EXPECT().
+		CompareCommits(noContext, scmRepo.Namespace, scmRepo.Name, "a", "b").
+		Return(diff, nil, nil)
+	client.EXPECT().
+		GetCommit(noContext, scmRepo.Namespace, scmRepo.Name, "c1").
+		Return(newGetCommitResponse(append(manyFiles("vendor", 200), "README.md"), nil).commit, nil, nil)
+	client.EXPECT().
+		GetCommit(noContext, scmRepo.Namespace, scmRepo.Name, "c2").
+		Return(newGetCommitResponse([]string{"README.md", "docs/index.md"}, nil).commit, nil, nil)
+
+	files, err := NewGithubProvider(client).ChangedFiles(noContext, scmRepo, drone.Build{Before: "a", After: "b"})
+	require.NoError(t, err)
+	require.Len(t, files, 202)
+	require.Equal(t, []File{
+		{Name: "README.md", Status: StatusModified},
+		{Name: "docs/index.md", Status: StatusModified},
+	}, files[200:])
+}
+
+func TestGithubProviderIncomplete(t *testing.T) {
+	tests := []struct {
+		name   string
+		build  drone.Build
+		diff   *github.CommitsComparison
+		commit *github.RepositoryCommit
+		err    string
+	}{
+		{
+			name:   "commit",
+			build:  drone.Build{After: "b"},
+			commit: newGetCommitResponse(manyFiles("vendor", githubFileLimit), nil).commit,
+			err:    "the list of changed files is incomplete: commit b changes at least 300 files",
+		},
+		{
+			name:  "comparison commits",
+			build: drone.Build{Before: "a", After: "b"},
+			diff: &github.CommitsComparison{
+				Files:        makeCommitFiles(manyFiles("vendor", githubFileLimit)),
+				TotalCommits: github.Int(300),
+				Commits:      makeCommits("c1"),
+			},
+			err: "the list of changed files is incomplete: the comparison lists 1 of 300 commits",
+		},
+		{
+			name:  "comparison commit files",
+			build: drone.Build{Before: "a", After: "b"},
+			diff: &github.CommitsComparison{
+				Files:        makeCommitFiles(manyFiles("vendor", githubFileLimit)),
+				TotalCommits: github.Int(1),
+				Commits:      makeCommits("c1"),
+			},
+			commit: newGetCommitResponse(manyFiles("vendor", githubFileLimit), nil).commit,
+			err:    "the list of changed files is incomplete: commit c1 changes at least 300 files",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := NewMockGithubRepositoryClient(ctrl)
+			if test.diff != nil {
+				client.EXPECT().
+					CompareCommits(noContext, scmRepo.Namespace, scmRepo.Name, "a", "b").
+					Return(test.diff, nil, nil)
+			}
+			if test.commit != nil {
+				client.EXPECT().
+					GetCommit(noContext, scmRepo.Namespace, scmRepo.Name, gomock.Any()).
+					Return(test.commit, nil, nil)
+			}
+
+			_, err := NewGithubProvider(client).ChangedFiles(noContext, scmRepo, test.build)
+			require.True(t, errors.Is(err, ErrIncomplete))
+			require.EqualError(t, err, test.err)
+		})
+	}
+}
+
+func TestPluginIncomplete(t *testing.T) {
+	// the output of an earlier conversion, which skipped pipelines
+	before, err := ioutil.ReadFile("testdata/pipeline.yml.golden")
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockGithubRepositoryClient(ctrl)
+	client.EXPECT().
+		GetCommit(noContext, "", "", "b").
+		Return(newGetCommitResponse(manyFiles("vendor", githubFileLimit), nil).commit, nil, nil)
+
+	config, err := New(NewGithubProvider(client)).Convert(noContext, &converter.Request{
+		Build:  drone.Build{After: "b"},
+		Repo:   drone.Repo{Config: ".drone.yml"},
+		Config: drone.Config{Data: string(before)},
+	})
+	require.NoError(t, err)
+	require.NotContains(t, config.Data, "exclude:\n      - '*'")
+	require.NotContains(t, config.Data, "x-infrastructure")
+}
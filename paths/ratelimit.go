@@ -0,0 +1,178 @@
+package paths
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/go-github/v28/github"
+	"github.com/sirupsen/logrus"
+)
+
+// githubMetrics publishes the rate limit of the GitHub API as last
+// reported by GitHub, and the requests retried because of it, on the
+// expvar endpoint
+var githubMetrics = expvar.NewMap("github_api")
+
+// the defaults of the retries of failed GitHub requests
+const (
+	githubRetries    = 3
+	githubBaseDelay  = 500 * time.Millisecond
+	githubMaxDelay   = 10 * time.Second
+	githubMaxWaiting = 30 * time.Second
+)
+
+// NewRateLimitedClient returns a client that retries the requests
+// failing on a rate limit or a server error up to retries times, or
+// three times if retries is negative. The retries back off with jitter
+// and stop at the deadline of the context, a request is not retried if
+// the rate limit resets after it.
+func NewRateLimitedClient(client GithubRepositoryClient, retries int) GithubRepositoryClient {
+	if retries < 0 {
+		retries = githubRetries
+	}
+	return &rateLimitedClient{
+		client:     client,
+		retries:    retries,
+		baseDelay:  githubBaseDelay,
+		maxDelay:   githubMaxDelay,
+		maxWaiting: githubMaxWaiting,
+	}
+}
+
+type rateLimitedClient struct {
+	client  GithubRepositoryClient
+	retries int
+	// baseDelay is doubled on every retry up to maxDelay, and no
+	// request waits more than maxWaiting for a rate limit to reset
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	maxWaiting time.Duration
+}
+
+func (c *rateLimitedClient) GetCommit(ctx context.Context, owner string, repo string, sha string) (*github.RepositoryCommit, *github.Response, error) {
+	var commit *github.RepositoryCommit
+	resp, err := c.do(ctx, func() (*github.Response, error) {
+		var resp *github.Response
+		var err error
+		commit, resp, err = c.client.GetCommit(ctx, owner, repo, sha)
+		return resp, err
+	})
+	return commit, resp, err
+}
+
+func (c *rateLimitedClient) CompareCommits(ctx context.Context, owner string, repo string, base string, head string) (*github.CommitsComparison, *github.Response, error) {
+	var comparison *github.CommitsComparison
+	resp, err := c.do(ctx, func() (*github.Response, error) {
+		var resp *github.Response
+		var err error
+		comparison, resp, err = c.client.CompareCommits(ctx, owner, repo, base, head)
+		return resp, err
+	})
+	return comparison, resp, err
+}
+
+// do calls the request until it succeeds, fails for good, or the
+// retries or the time left run out
+func (c *rateLimitedClient) do(ctx context.Context, request func() (*github.Response, error)) (*github.Response, error) {
+	for attempt := 0; ; attempt++ {
+		githubMetrics.Add("requests", 1)
+		resp, err := request()
+		observeRate(resp)
+		if err == nil {
+			return resp, nil
+		}
+		wait, ok := c.backoff(ctx, err, attempt)
+		if !ok || attempt >= c.retries {
+			githubMetrics.Add("failures", 1)
+			return resp, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			githubMetrics.Add("failures", 1)
+			return resp, err
+		}
+		logrus.WithError(err).
+			WithField("wait", wait).
+			Debugln("retrying github request")
+		githubMetrics.Add("retries", 1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			githubMetrics.Add("failures", 1)
+			return resp, err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns how long to wait before retrying after the error,
+// and false if the request should not be retried
+func (c *rateLimitedClient) backoff(ctx context.Context, err error, attempt int) (time.Duration, bool) {
+	if ctx.Err() != nil {
+		return 0, false
+	}
+	var rateLimitErr *github.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		githubMetrics.Add("rate_limited", 1)
+		wait := time.Until(rateLimitErr.Rate.Reset.Time)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, wait <= c.maxWaiting
+	}
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		githubMetrics.Add("secondary_rate_limited", 1)
+		if abuseErr.RetryAfter != nil {
+			return *abuseErr.RetryAfter, *abuseErr.RetryAfter <= c.maxWaiting
+		}
+		return c.jitter(attempt), true
+	}
+	var responseErr *github.ErrorResponse
+	if errors.As(err, &responseErr) {
+		if responseErr.Response == nil || responseErr.Response.StatusCode < http.StatusInternalServerError {
+			return 0, false
+		}
+		return c.jitter(attempt), true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return c.jitter(attempt), true
+	}
+	return 0, false
+}
+
+// jitter returns a random delay between half and the whole of the
+// exponential delay of the attempt, so that the requests failing
+// together are not retried together
+func (c *rateLimitedClient) jitter(attempt int) time.Duration {
+	delay := c.maxDelay
+	if attempt < 32 && c.baseDelay<<uint(attempt) < c.maxDelay {
+		delay = c.baseDelay << uint(attempt)
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// observeRate publishes the rate limit reported by the response
+func observeRate(resp *github.Response) {
+	if resp == nil || resp.Rate.Limit == 0 {
+		return
+	}
+	setMetric("rate_limit", int64(resp.Rate.Limit))
+	setMetric("rate_remaining", int64(resp.Rate.Remaining))
+	setMetric("rate_reset", resp.Rate.Reset.Unix())
+}
+
+func setMetric(key string, value int64) {
+	metric := new(expvar.Int)
+	metric.Set(value)
+	githubMetrics.Set(key, metric)
+}
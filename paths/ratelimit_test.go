@@ -0,0 +1,196 @@
+package paths
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/converter"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-github/v28/github"
+	"github.com/stretchr/testify/require"
+)
+
+// githubStatus is a canned response of the stand-in GitHub server
+type githubStatus struct {
+	code   int
+	header map[string]string
+	body   string
+}
+
+// newGithubServer returns a client of a server answering the requests
+// for commits with the responses in turn, and the number of requests
+func newGithubServer(t *testing.T, responses ...githubStatus) (*httptest.Server, *rateLimitedClient, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/octocat/hello-world/commits/b" {
+			t.Errorf("unexpected request %s", r.URL.RequestURI())
+		}
+		if requests >= len(responses) {
+			t.Errorf("unexpected request %d", requests+1)
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		response := responses[requests]
+		requests++
+		for key, value := range response.header {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(response.code)
+		fmt.Fprint(w, response.body)
+	}))
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	limited := NewRateLimitedClient(client.Repositories, 2).(*rateLimitedClient)
+	limited.baseDelay = time.Millisecond
+	limited.maxDelay = 4 * time.Millisecond
+	return server, limited, &requests
+}
+
+var (
+	commitFound = githubStatus{
+		code: http.StatusOK,
+		header: map[string]string{
+			"X-RateLimit-Limit":     "5000",
+			"X-RateLimit-Remaining": "4999",
+			"X-RateLimit-Reset":     "1600000000",
+		},
+		body: `{"sha": "b", "files": [{"filename": "README.md"}]}`,
+	}
+	serverError = githubStatus{
+		code: http.StatusBadGateway,
+		body: `{"message": "Server Error"}`,
+	}
+)
+
+func rateLimited(reset time.Time) githubStatus {
+	return githubStatus{
+		code: http.StatusForbidden,
+		header: map[string]string{
+			"X-RateLimit-Limit":     "5000",
+			"X-RateLimit-Remaining": "0",
+			"X-RateLimit-Reset":     strconv.FormatInt(reset.Unix(), 10),
+		},
+		body: `{"message": "API rate limit exceeded for user ID 1."}`,
+	}
+}
+
+func TestRateLimitedClientRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []githubStatus
+	}{
+		{
+			name:      "server error",
+			responses: []githubStatus{serverError, serverError, commitFound},
+		},
+		{
+			name: "secondary rate limit",
+			responses: []githubStatus{
+				{
+					code:   http.StatusForbidden,
+					header: map[string]string{"Retry-After": "0"},
+					body:   `{"message": "You have triggered an abuse detection mechanism.", "documentation_url": "https://developer.github.com/v3/#abuse-rate-limits"}`,
+				},
+				commitFound,
+			},
+		},
+		{
+			name:      "rate limit reset",
+			responses: []githubStatus{rateLimited(time.Now().Add(-time.Second)), commitFound},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client, requests := newGithubServer(t, test.responses...)
+			defer server.Close()
+			commit, _, err := client.GetCommit(noContext, "octocat", "hello-world", "b")
+			require.NoError(t, err)
+			require.Equal(t, "README.md", commit.Files[0].GetFilename())
+			require.Equal(t, len(test.responses), *requests)
+			require.Equal(t, "4999", githubMetrics.Get("rate_remaining").String())
+			require.Equal(t, "5000", githubMetrics.Get("rate_limit").String())
+		})
+	}
+}
+
+func TestRateLimitedClientGivesUp(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []githubStatus
+		timeout   time.Duration
+	}{
+		{
+			name:      "client error",
+			responses: []githubStatus{{code: http.StatusNotFound, body: `{"message": "Not Found"}`}},
+		},
+		{
+			name:      "retries",
+			responses: []githubStatus{serverError, serverError, serverError},
+		},
+		{
+			name:      "rate limit",
+			responses: []githubStatus{rateLimited(time.Now().Add(time.Hour))},
+		},
+		{
+			name:      "deadline",
+			responses: []githubStatus{rateLimited(time.Now().Add(10 * time.Second))},
+			timeout:   time.Second,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client, requests := newGithubServer(t, test.responses...)
+			defer server.Close()
+			ctx := noContext
+			if test.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+			start := time.Now()
+			_, _, err := client.GetCommit(ctx, "octocat", "hello-world", "b")
+			require.Error(t, err)
+			require.Equal(t, len(test.responses), *requests)
+			require.True(t, time.Since(start) < time.Second)
+		})
+	}
+}
+
+func TestPluginFailOpen(t *testing.T) {
+	// the output of an earlier conversion, which skipped pipelines
+	before, err := ioutil.ReadFile("testdata/pipeline.yml.golden")
+	require.NoError(t, err)
+	req := func() *converter.Request {
+		return &converter.Request{
+			Build:  drone.Build{After: "b"},
+			Repo:   drone.Repo{Config: ".drone.yml"},
+			Config: drone.Config{Data: string(before)},
+		}
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := NewMockGithubRepositoryClient(ctrl)
+	client.EXPECT().
+		GetCommit(gomock.Any(), "", "", "b").
+		Return(nil, nil, errors.New("unavailable")).
+		Times(2)
+
+	_, err = New(NewGithubProvider(client)).Convert(noContext, req())
+	require.EqualError(t, err, "paths: .drone.yml: cannot query source control: unavailable")
+
+	config, err := New(NewGithubProvider(client), WithFailOpen()).Convert(noContext, req())
+	require.NoError(t, err)
+	require.NotContains(t, config.Data, "exclude:\n      - '*'")
+	require.NotContains(t, config.Data, "x-infrastructure")
+}
@@ -0,0 +1,60 @@
+package paths
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// apiClient performs authenticated requests against the json api of
+// a source control server
+type apiClient struct {
+	endpoint string
+	// header and value authenticate the requests, the header is
+	// omitted when the value is empty
+	header string
+	value  string
+	client *http.Client
+}
+
+func newAPIClient(endpoint, header, value string) *apiClient {
+	return &apiClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		header:   header,
+		value:    value,
+		client:   http.DefaultClient,
+	}
+}
+
+// get decodes the response to the request of path into v, the path
+// must already be escaped
+func (c *apiClient) get(ctx context.Context, path string, query url.Values, v interface{}) (http.Header, error) {
+	target := c.endpoint + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if c.value != "" {
+		req.Header.Set(c.header, c.value)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, fmt.Errorf("GET %s: %s", target, res.Status)
+	}
+	return res.Header, json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,160 @@
+package paths
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/stretchr/testify/require"
+)
+
+// scmRoute is a canned response of the stand-in scm server
+type scmRoute struct {
+	// uri is the escaped path and query expected
+	uri    string
+	header map[string]string
+	body   string
+}
+
+// newSCMServer returns a server answering the routes, and failing the
+// test on any other request or on a missing authentication header
+func newSCMServer(t *testing.T, auth, value string, routes ...scmRoute) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get(auth); got != value {
+			t.Errorf("expected %s header %q, got %q", auth, value, got)
+		}
+		for _, route := range routes {
+			if route.uri == r.URL.RequestURI() {
+				for key, value := range route.header {
+					w.Header().Set(key, value)
+				}
+				fmt.Fprint(w, route.body)
+				return
+			}
+		}
+		t.Errorf("unexpected request %s", r.URL.RequestURI())
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+var scmRepo = drone.Repo{
+	Namespace: "octocat",
+	Name:      "hello-world",
+	Slug:      "octocat/hello-world",
+}
+
+func TestGitlabProvider(t *testing.T) {
+	server := newSCMServer(t, "PRIVATE-TOKEN", "secret",
+		scmRoute{
+			uri:    "/api/v4/projects/octocat%2Fhello-world/repository/commits/b/diff?page=1&per_page=100",
+			header: map[string]string{"X-Next-Page": "2"},
+			body:   `[{"old_path": "README.md", "new_path": "README.md"}]`,
+		},
+		scmRoute{
+			uri:  "/api/v4/projects/octocat%2Fhello-world/repository/commits/b/diff?page=2&per_page=100",
+			body: `[{"old_path": "old.go", "new_path": "main.go", "renamed_file": true}]`,
+		},
+		scmRoute{
+			uri:  "/api/v4/projects/octocat%2Fhello-world/repository/compare?from=a&to=b",
+			body: `{"diffs": [{"new_path": "docs/index.md", "new_file": true}, {"new_path": "README.md", "deleted_file": true}]}`,
+		},
+	)
+	defer server.Close()
+	provider := NewGitlabProvider(server.URL+"/", "secret")
+
+	files, err := provider.ChangedFiles(noContext, scmRepo, drone.Build{After: "b"})
+	require.NoError(t, err)
+	require.Equal(t, []File{
+		{Name: "README.md", Status: StatusModified},
+		{Name: "main.go", Previous: "old.go", Status: StatusRenamed},
+	}, files)
+
+	files, err = provider.ChangedFiles(noContext, scmRepo, drone.Build{Before: "a", After: "b"})
+	require.NoError(t, err)
+	require.Equal(t, []File{
+		{Name: "docs/index.md", Status: StatusAdded},
+		{Name: "README.md", Status: StatusRemoved},
+	}, files)
+}
+
+func TestGiteaProvider(t *testing.T) {
+	server := newSCMServer(t, "Authorization", "token secret",
+		scmRoute{
+			uri:  "/api/v1/repos/octocat/hello-world/git/commits/b",
+			body: `{"sha": "b", "files": [{"filename": "README.md", "status": "modified"}]}`,
+		},
+		scmRoute{
+			uri: "/api/v1/repos/octocat/hello-world/compare/a...b",
+			body: `{"total_commits": 2, "commits": [
+				{"files": [{"filename": "main.go", "status": "added"}, {"filename": "README.md", "status": "modified"}]},
+				{"files": [{"filename": "README.md", "status": "modified"}]}
+			]}`,
+		},
+	)
+	defer server.Close()
+	provider := NewGiteaProvider(server.URL, "secret")
+
+	files, err := provider.ChangedFiles(noContext, scmRepo, drone.Build{After: "b"})
+	require.NoError(t, err)
+	require.Equal(t, []File{{Name: "README.md", Status: StatusModified}}, files)
+
+	files, err = provider.ChangedFiles(noContext, scmRepo, drone.Build{Before: "a", After: "b"})
+	require.NoError(t, err)
+	require.Equal(t, []File{
+		{Name: "main.go", Status: StatusAdded},
+		{Name: "README.md", Status: StatusModified},
+	}, files)
+}
+
+func TestBitbucketProvider(t *testing.T) {
+	server := newSCMServer(t, "Authorization", "Bearer secret",
+		scmRoute{
+			uri:  "/rest/api/1.0/projects/octocat/repos/hello-world/changes?limit=1000&start=0&until=b",
+			body: `{"values": [{"path": {"toString": "README.md"}, "type": "DELETE"}], "isLastPage": true}`,
+		},
+		scmRoute{
+			uri:  "/rest/api/1.0/projects/octocat/repos/hello-world/changes?limit=1000&since=a&start=0&until=b",
+			body: `{"values": [{"path": {"toString": "main.go"}, "srcPath": {"toString": "old.go"}, "type": "MOVE"}], "isLastPage": false, "nextPageStart": 1}`,
+		},
+		scmRoute{
+			uri:  "/rest/api/1.0/projects/octocat/repos/hello-world/changes?limit=1000&since=a&start=1&until=b",
+			body: `{"values": [{"path": {"toString": "docs/index.md"}, "type": "ADD"}], "isLastPage": true}`,
+		},
+		scmRoute{
+			uri:  "/rest/api/1.0/projects/octocat/repos/hello-world/pull-requests/7/changes?limit=1000&start=0",
+			body: `{"values": [{"path": {"toString": "feature.go"}, "type": "MODIFY"}], "isLastPage": true}`,
+		},
+	)
+	defer server.Close()
+	provider := NewBitbucketProvider(server.URL, "secret")
+
+	files, err := provider.ChangedFiles(noContext, scmRepo, drone.Build{After: "b"})
+	require.NoError(t, err)
+	require.Equal(t, []File{{Name: "README.md", Status: StatusRemoved}}, files)
+
+	files, err = provider.ChangedFiles(noContext, scmRepo, drone.Build{Before: "a", After: "b"})
+	require.NoError(t, err)
+	require.Equal(t, []File{
+		{Name: "main.go", Previous: "old.go", Status: StatusRenamed},
+		{Name: "docs/index.md", Status: StatusAdded},
+	}, files)
+
+	files, err = provider.ChangedFiles(noContext, scmRepo, drone.Build{
+		Event:  drone.EventPullRequest,
+		Ref:    "refs/pull-requests/7/from",
+		Before: "master",
+		After:  "b",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []File{{Name: "feature.go", Status: StatusModified}}, files)
+}
+
+func TestSCMProviderError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, err := NewGiteaProvider(server.URL, "").ChangedFiles(noContext, scmRepo, drone.Build{After: "b"})
+	require.EqualError(t, err, "GET "+server.URL+"/api/v1/repos/octocat/hello-world/git/commits/b: 404 Not Found")
+}
@@ -0,0 +1,176 @@
+package paths
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
+	"gopkg.in/yaml.v3"
+)
+
+// kindPaths is the kind of the documents that define path sets
+const kindPaths = "paths"
+
+// setPrefix marks a pattern as a reference to a path set
+const setPrefix = "@"
+
+// PathSets are named lists of patterns that path conditions refer to
+// with "@name"
+type PathSets map[string][]string
+
+// LoadPathSets reads path sets from a yaml file mapping names to patterns
+func LoadPathSets(file string) (PathSets, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sets := PathSets{}
+	if err := yaml.Unmarshal(data, &sets); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return sets, nil
+}
+
+// decodePathSets decodes a paths document, every key but kind and name
+// is a set
+func decodePathSets(root *yaml.Node) (PathSets, error) {
+	sets := PathSets{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i].Value
+		if key == "kind" || key == "name" {
+			continue
+		}
+		var patterns []string
+		if err := root.Content[i+1].Decode(&patterns); err != nil {
+			return nil, err
+		}
+		sets[key] = patterns
+	}
+	return sets, nil
+}
+
+// pathSets returns the sets of the plugin together with the sets
+// defined by the configuration, and removes their documents
+func (p *plugin) pathSets(config *document.Config) (PathSets, error) {
+	sets := PathSets{}
+	for name, patterns := range p.sets {
+		sets[name] = patterns
+	}
+	docs := []*document.Document{}
+	for _, doc := range config.Documents {
+		if doc.Kind() == kindPaths {
+			docs = append(docs, doc)
+		}
+	}
+	for _, doc := range docs {
+		defined, err := decodePathSets(doc.Root())
+		if err != nil {
+			return nil, err
+		}
+		for name, patterns := range defined {
+			sets[name] = patterns
+		}
+		config.Remove(doc)
+	}
+	return sets, nil
+}
+
+// expandPipeline replaces the references to path sets in the paths
+// conditions of the pipeline and its steps with their patterns
+func (s PathSets) expandPipeline(doc *document.Document) error {
+	root := doc.Root()
+	nodes := []*yaml.Node{}
+	if trigger := document.Lookup(root, "trigger"); trigger != nil {
+		nodes = append(nodes, document.Lookup(trigger, "paths"))
+	}
+	if steps := document.Lookup(root, "steps"); steps != nil {
+		for _, node := range steps.Content {
+			if when := document.Lookup(node, "when"); when != nil {
+				nodes = append(nodes, document.Lookup(when, "paths"))
+			}
+		}
+	}
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		expanded, err := s.expandNode(node)
+		if err != nil {
+			return err
+		}
+		if expanded {
+			doc.Touch()
+		}
+	}
+	return nil
+}
+
+// expandNode replaces the references in the sequences of the node. An
+// anchored node is expanded in place, which gives the same result for
+// every alias since the sets are the same for the whole document.
+func (s PathSets) expandNode(node *yaml.Node) (bool, error) {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	expanded := false
+	switch node.Kind {
+	case yaml.SequenceNode:
+		content := []*yaml.Node{}
+		for _, item := range node.Content {
+			if item.Kind == yaml.ScalarNode && strings.HasPrefix(item.Value, setPrefix) {
+				patterns, err := s.expand(item.Value, nil)
+				if err != nil {
+					return false, err
+				}
+				for _, pattern := range patterns {
+					content = append(content, document.Scalar(pattern))
+				}
+				expanded = true
+				continue
+			}
+			ok, err := s.expandNode(item)
+			if err != nil {
+				return false, err
+			}
+			expanded = expanded || ok
+			content = append(content, item)
+		}
+		node.Content = content
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			ok, err := s.expandNode(node.Content[i])
+			if err != nil {
+				return false, err
+			}
+			expanded = expanded || ok
+		}
+	}
+	return expanded, nil
+}
+
+// expand returns the patterns of the set the reference refers to, sets
+// can refer to other sets
+func (s PathSets) expand(reference string, seen []string) ([]string, error) {
+	if !strings.HasPrefix(reference, setPrefix) {
+		return []string{reference}, nil
+	}
+	name := strings.TrimPrefix(reference, setPrefix)
+	if contains(seen, name) {
+		return nil, fmt.Errorf("path set %q refers to itself", name)
+	}
+	patterns, ok := s[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown path set %q", name)
+	}
+	seen = append(seen[:len(seen):len(seen)], name)
+	expanded := []string{}
+	for _, pattern := range patterns {
+		more, err := s.expand(pattern, seen)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, more...)
+	}
+	return expanded, nil
+}
@@ -1,20 +1,33 @@
 package paths
 
+import (
+	"github.com/andrewstucki/drone-infrastructure-plugin/document"
+	"gopkg.in/yaml.v3"
+)
+
 type step struct {
-	When  conditions             `yaml:"when,omitempty"`
-	Attrs map[string]interface{} `yaml:",inline"`
+	Name      string
+	When      conditions
+	DependsOn []string
 }
 
-func (s *step) matchOrExclude(changedFiles []string) bool {
-	for _, p := range changedFiles {
-		if s.When.Paths.match(p) {
-			return false
+func newStep(node *yaml.Node) (*step, error) {
+	s := &step{
+		Name: document.ScalarValue(node, "name"),
+	}
+	if when := document.Lookup(node, "when"); when != nil {
+		if err := when.Decode(&s.When); err != nil {
+			return nil, err
 		}
 	}
-	// if only When.Paths is set, When.Attrs will be unset, so it must be initialized
-	if s.When.Attrs == nil {
-		s.When.Attrs = make(map[string]interface{})
+	if dependsOn := document.Lookup(node, "depends_on"); dependsOn != nil {
+		if err := dependsOn.Decode(&s.DependsOn); err != nil {
+			return nil, err
+		}
 	}
-	s.When.Attrs["event"] = map[string][]string{"exclude": {"*"}}
-	return true
+	return s, nil
+}
+
+func (s *step) match(changedFiles []File) bool {
+	return s.When.Paths.match(changedFiles)
 }
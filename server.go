@@ -2,20 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/99designs/httpsignatures-go"
 	"github.com/andrewstucki/drone-infrastructure-plugin/cache"
 	"github.com/andrewstucki/drone-infrastructure-plugin/chain"
 	"github.com/andrewstucki/drone-infrastructure-plugin/deploy"
+	"github.com/andrewstucki/drone-infrastructure-plugin/githubapp"
 	"github.com/andrewstucki/drone-infrastructure-plugin/paths"
 	"github.com/aws/aws-sdk-go-v2/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	admitPlugin "github.com/drone/drone-admit-members/plugin"
 	awsSecretPlugin "github.com/drone/drone-amazon-secrets/plugin"
+	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/admission"
 	"github.com/drone/drone-go/plugin/converter"
 	"github.com/drone/drone-go/plugin/secret"
@@ -25,10 +35,16 @@ import (
 )
 
 func initializeServer(spec *spec) *http.Server {
-	client := setupGithubClient(spec)
+	app := setupGithubApp(spec)
+	client := setupGithubClient(spec, app)
+	recorder := setupRecorder(spec)
 	plugin := chain.New().
 		WithAdmission(setupAdmission(client, spec)).
-		WithConverters(setupConvert(client)).
+		WithConverters(setupConvert(spec, setupChangedFiles(spec, client, app), recorder)).
+		WithErrorPolicy(setupErrorPolicy(spec)).
+		WithRules(setupRules(spec)).
+		WithCache(setupCache(spec)).
+		WithTimeout(spec.ConvertTimeout).
 		WithSecrets(setupSecrets())
 
 	router := http.NewServeMux()
@@ -36,6 +52,10 @@ func initializeServer(spec *spec) *http.Server {
 	router.Handle("/convert", plugin.ConvertHandler(spec.Secret))
 	router.Handle("/secret", plugin.SecretHandler(spec.Secret))
 	router.HandleFunc("/healthz", healthz)
+	router.Handle("/debug/vars", signed(spec.Secret, expvar.Handler()))
+	if recorder != nil {
+		router.Handle("/debug/paths", signed(spec.Secret, recorder))
+	}
 
 	return &http.Server{
 		Addr:    spec.Bind,
@@ -43,12 +63,17 @@ func initializeServer(spec *spec) *http.Server {
 	}
 }
 
-func setupGithubClient(spec *spec) *github.Client {
+func setupGithubClient(spec *spec, app *githubapp.App) *github.Client {
 	// creates the github client transport used
 	// to authenticate API requests.
-	trans := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: spec.Token},
-	))
+	var trans *http.Client
+	if app != nil {
+		trans = app.Client(spec.Org)
+	} else {
+		trans = oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: spec.Token},
+		))
+	}
 
 	// create the github client
 	client, err := github.NewEnterpriseClient(spec.Endpoint, spec.Endpoint, trans)
@@ -59,6 +84,23 @@ func setupGithubClient(spec *spec) *github.Client {
 	return client
 }
 
+// setupGithubApp returns the github app authenticating the requests, or
+// nil when the token is used instead
+func setupGithubApp(spec *spec) *githubapp.App {
+	if spec.AppID == 0 {
+		return nil
+	}
+	key, err := githubapp.LoadPrivateKey(spec.AppPrivateKey)
+	if err != nil {
+		logrus.WithError(err).Fatalln("cannot load github app private key")
+	}
+	app, err := githubapp.New(spec.Endpoint, spec.AppID, key)
+	if err != nil {
+		logrus.WithError(err).Fatalln("invalid github endpoint")
+	}
+	return app
+}
+
 func setupSecrets() []secret.Plugin {
 	external.LoadDefaultAWSConfig()
 	cfg, err := external.LoadDefaultAWSConfig()
@@ -108,14 +150,221 @@ func setupAdmission(client *github.Client, spec *spec) []admission.Plugin {
 	return []admission.Plugin{admitPlugin.New(client, spec.Org, team)}
 }
 
-func setupConvert(client *github.Client) []converter.Plugin {
+func setupChangedFiles(spec *spec, client *github.Client, app *githubapp.App) paths.ChangedFilesProvider {
+	switch spec.ChangedFiles {
+	case "api":
+		return setupSCMProvider(spec, client)
+	case "git":
+		// the mirrors authenticate like the api requests
+		tokens := paths.StaticToken(spec.Token)
+		if app != nil {
+			tokens = app.Token
+		}
+		return paths.NewGitMirror(spec.GitMirrorPath, githubHost(spec), tokens)
+	case "static":
+		return paths.NewStaticProvider(spec.StaticChangedFiles...)
+	}
+	logrus.WithField("provider", spec.ChangedFiles).Fatalln("unknown changed files provider")
+	return nil
+}
+
+// githubHost returns the url of the github server of the api endpoint,
+// the only host the mirrors send the token to
+func githubHost(spec *spec) string {
+	endpoint, err := url.Parse(spec.Endpoint)
+	if err != nil {
+		logrus.WithError(err).Fatalln("invalid github endpoint")
+	}
+	if endpoint.Host == "api.github.com" {
+		return "https://github.com"
+	}
+	return endpoint.Scheme + "://" + endpoint.Host
+}
+
+func setupSCMProvider(spec *spec, client *github.Client) paths.ChangedFilesProvider {
+	if spec.SCMDriver != "github" && spec.SCMEndpoint == "" {
+		logrus.WithField("driver", spec.SCMDriver).Fatalln("missing source control endpoint")
+	}
+	switch spec.SCMDriver {
+	case "github":
+		return paths.NewGithubProvider(paths.NewRateLimitedClient(client.Repositories, spec.Retries))
+	case "gitlab":
+		return paths.NewGitlabProvider(spec.SCMEndpoint, spec.SCMToken)
+	case "gitea":
+		return paths.NewGiteaProvider(spec.SCMEndpoint, spec.SCMToken)
+	case "bitbucket":
+		return paths.NewBitbucketProvider(spec.SCMEndpoint, spec.SCMToken)
+	}
+	logrus.WithField("driver", spec.SCMDriver).Fatalln("unknown source control driver")
+	return nil
+}
+
+func setupConvert(spec *spec, provider paths.ChangedFilesProvider, recorder *paths.Recorder) []converter.Plugin {
+	dependencies, err := paths.ParseDependencyPolicy(spec.DependencyPolicy)
+	if err != nil {
+		logrus.WithError(err).Fatalln("invalid paths dependency policy")
+	}
+	options := []paths.Option{paths.WithDependencyPolicy(dependencies)}
+	if spec.RemoveSkipped {
+		options = append(options, paths.WithRemoveSkipped())
+	}
+	if spec.FailOpen {
+		options = append(options, paths.WithFailOpen())
+	}
+	if spec.Explain {
+		options = append(options, paths.WithExplain())
+	}
+	if recorder != nil {
+		options = append(options, paths.WithRecorder(recorder))
+	}
+	if sources, ok := provider.(paths.GoSourceReader); ok {
+		options = append(options, paths.WithGoSources(sources))
+	}
+	for event, name := range spec.EventPolicies {
+		policy, err := paths.ParseEventPolicy(name)
+		if err != nil {
+			logrus.WithError(err).
+				WithField("event", event).
+				Fatalln("invalid paths event policy")
+		}
+		if policy == paths.EventLastSuccess && spec.DroneEndpoint == "" {
+			logrus.WithField("event", event).Fatalln("missing drone api endpoint")
+		}
+		options = append(options, paths.WithEventPolicy(event, policy))
+	}
+	if spec.DroneEndpoint != "" {
+		options = append(options, paths.WithBuildHistory(paths.NewDroneHistory(setupDroneClient(spec), spec.HistoryDepth)))
+	}
+	if spec.PathSetsFile != "" {
+		sets, err := paths.LoadPathSets(spec.PathSetsFile)
+		if err != nil {
+			logrus.WithError(err).Fatalln("cannot load path sets")
+		}
+		options = append(options, paths.WithPathSets(sets))
+	}
 	return []converter.Plugin{
-		cache.New(),
-		paths.New(client.Repositories),
+		setupCacheConverter(spec),
+		paths.New(provider, options...),
 		deploy.New(),
 	}
 }
 
+func setupCacheConverter(spec *spec) converter.Plugin {
+	backend, err := cache.ParseBackend(spec.CacheBackend)
+	if err != nil {
+		logrus.WithError(err).Fatalln("invalid cache backend")
+	}
+	return cache.New(
+		cache.WithBackend(backend),
+		cache.WithEndpoint(spec.CacheEndpoint),
+		cache.WithVolume(spec.CacheVolume),
+	)
+}
+
+func setupDroneClient(spec *spec) drone.Client {
+	client := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: spec.DroneToken},
+	))
+	return drone.NewClient(spec.DroneEndpoint, client)
+}
+
+func setupRecorder(spec *spec) *paths.Recorder {
+	if spec.Decisions <= 0 {
+		return nil
+	}
+	return paths.NewRecorder(spec.Decisions)
+}
+
+func setupErrorPolicy(spec *spec) (chain.Policy, map[string]chain.Policy) {
+	policy, err := chain.ParsePolicy(spec.ErrorPolicy)
+	if err != nil {
+		logrus.WithError(err).Fatalln("invalid converter error policy")
+	}
+	overrides := make(map[string]chain.Policy, len(spec.ErrorPolicies))
+	for converter, name := range spec.ErrorPolicies {
+		override, err := chain.ParsePolicy(name)
+		if err != nil {
+			logrus.WithError(err).
+				WithField("converter", converter).
+				Fatalln("invalid converter error policy")
+		}
+		overrides[converter] = override
+	}
+	return policy, overrides
+}
+
+func setupRules(spec *spec) map[string]chain.Rule {
+	rules := map[string]chain.Rule{}
+	for converter, repos := range spec.ConvertRepos {
+		rule := rules[converter]
+		rule.Repos = strings.Split(repos, "|")
+		rules[converter] = rule
+	}
+	for converter, namespaces := range spec.ConvertNamespaces {
+		rule := rules[converter]
+		rule.Namespaces = strings.Split(namespaces, "|")
+		rules[converter] = rule
+	}
+	for _, converter := range spec.ConvertOptIn {
+		rule := rules[converter]
+		rule.OptIn = true
+		rules[converter] = rule
+	}
+	return rules
+}
+
+func setupCache(spec *spec) *chain.ResultCache {
+	if spec.ConvertCacheSize <= 0 {
+		return nil
+	}
+	results, err := chain.NewResultCache(spec.ConvertCacheSize, spec.ConvertCacheTTL, spec.ConvertCachePath)
+	if err != nil {
+		logrus.WithError(err).
+			WithField("path", spec.ConvertCachePath).
+			Fatalln("cannot open conversion cache")
+	}
+	return results.WithSettings(settingsFingerprint(spec))
+}
+
+// settingsFingerprint hashes the settings along with the path sets they
+// load, leaving the credentials out, so that the persisted conversion
+// results are not reused once the settings change
+func settingsFingerprint(spec *spec) string {
+	settings := *spec
+	settings.Secret, settings.Token, settings.SCMToken, settings.DroneToken = "", "", "", ""
+	data, err := json.Marshal(settings)
+	if err != nil {
+		logrus.WithError(err).Fatalln("cannot fingerprint the settings")
+	}
+	hash := sha256.New()
+	hash.Write(data)
+	if spec.PathSetsFile != "" {
+		sets, err := ioutil.ReadFile(spec.PathSetsFile)
+		if err != nil {
+			logrus.WithError(err).Fatalln("cannot load path sets")
+		}
+		hash.Write(sets)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// signed serves the requests signed with the secret, the way drone signs
+// the requests to the extensions, and rejects the others
+func signed(secret string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature, err := httpsignatures.FromRequest(r)
+		if err != nil {
+			http.Error(w, "Invalid or Missing Signature", http.StatusBadRequest)
+			return
+		}
+		if !signature.IsValid(secret, r) {
+			http.Error(w, "Invalid Signature", http.StatusBadRequest)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 func healthz(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	io.WriteString(w, "OK")
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/99designs/httpsignatures-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigned(t *testing.T) {
+	handler := signed("correct-horse-battery-staple", http.HandlerFunc(healthz))
+	serve := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/debug/paths", nil)
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		if key != "" {
+			require.NoError(t, httpsignatures.DefaultSha256Signer.SignRequest("hmac-key", key, req))
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+	require.Equal(t, http.StatusOK, serve("correct-horse-battery-staple"))
+	require.Equal(t, http.StatusBadRequest, serve("wrong"))
+	require.Equal(t, http.StatusBadRequest, serve(""))
+}
+
+func TestSettingsFingerprint(t *testing.T) {
+	settings := &spec{CacheBackend: "s3", Token: "a"}
+	fingerprint := settingsFingerprint(settings)
+
+	// the credentials are left out
+	settings.Token = "b"
+	require.Equal(t, fingerprint, settingsFingerprint(settings))
+
+	settings.CacheBackend = "gcs"
+	require.NotEqual(t, fingerprint, settingsFingerprint(settings))
+}